@@ -0,0 +1,391 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	actionDir    = "ac"
+	manifestName = "manifest.json"
+	tempPrefix   = "tmp-"
+)
+
+type Cache interface {
+	Get(context.Context, string, string) (bool, error)
+	Put(context.Context, string, string, []string) error
+	Stats(context.Context) (*Stats, error)
+	Clean(context.Context) error
+}
+
+type Config struct {
+	Dir     string
+	MaxSize int64
+}
+
+// Input is a build file and its checksum
+type Input struct {
+	Path     string
+	Checksum string
+}
+
+type Stats struct {
+	Dir     string
+	Entries int
+	Size    int64
+	MaxSize int64
+}
+
+type Output struct {
+	Path string      `json:"path"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+}
+
+type Manifest struct {
+	Outputs []Output `json:"outputs"`
+}
+
+type entry struct {
+	key   string
+	size  int64
+	atime time.Time
+}
+
+type cache struct {
+	cfg   *Config
+	mutex sync.Mutex
+	size  int64
+	known bool
+}
+
+func New(_ context.Context, cfg *Config) Cache {
+	return &cache{
+		cfg: cfg,
+	}
+}
+
+func DefaultConfig() *Config {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return &Config{
+		Dir:     filepath.Join(dir, "boong", "proxy"),
+		MaxSize: 10 << 30,
+	}
+}
+
+// Key digests the normalized rule, the checksums of all inputs and the declared targets
+func Key(rule string, inputs []Input, targets []string) string {
+	hash := sha256.New()
+
+	_, _ = io.WriteString(hash, strings.Join(strings.Fields(rule), " "))
+	_, _ = hash.Write([]byte{0})
+
+	buf := make([]Input, len(inputs))
+	copy(buf, inputs)
+	sort.Slice(buf, func(i, j int) bool {
+		return buf[i].Path < buf[j].Path
+	})
+
+	for _, item := range buf {
+		_, _ = io.WriteString(hash, filepath.ToSlash(item.Path)+"\x00"+item.Checksum+"\x00")
+	}
+
+	_, _ = hash.Write([]byte{0})
+
+	for _, item := range targets {
+		_, _ = io.WriteString(hash, filepath.ToSlash(item)+"\x00")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ParseSize parses sizes such as 512M, 10G or 1TB into bytes
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix string
+		shift  uint
+	}{
+		{"TB", 40}, {"GB", 30}, {"MB", 20}, {"KB", 10},
+		{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}, {"B", 0},
+	}
+
+	s := strings.ToUpper(strings.TrimSpace(size))
+	shift := uint(0)
+
+	for _, item := range units {
+		if strings.HasSuffix(s, item.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, item.suffix))
+			shift = item.shift
+			break
+		}
+	}
+
+	num, err := strconv.ParseFloat(s, 64)
+	if err != nil || num < 0 {
+		return 0, errors.New("invalid size " + size + "\n")
+	}
+
+	return int64(num * float64(int64(1)<<shift)), nil
+}
+
+// Get restores the outputs of key into root, returning false on a miss
+func (c *cache) Get(_ context.Context, key, root string) (bool, error) {
+	dir := c.entryDir(key)
+
+	buf, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to read manifest\n")
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal manifest\n")
+	}
+
+	for i, item := range manifest.Outputs {
+		if err := copyFile(filepath.Join(dir, strconv.Itoa(i)), filepath.Join(root, item.Path), item.Mode); err != nil {
+			return false, errors.Wrap(err, "failed to restore "+item.Path+"\n")
+		}
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(dir, manifestName), now, now)
+
+	return true, nil
+}
+
+// Put stores the targets under root as the outputs of key, evicting least recently used entries
+func (c *cache) Put(_ context.Context, key, root string, targets []string) error {
+	if err := c.load(); err != nil {
+		return errors.Wrap(err, "failed to load cache\n")
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.cfg.Dir, actionDir), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to make directory\n")
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Join(c.cfg.Dir, actionDir), tempPrefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to make temp directory\n")
+	}
+
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(tmp)
+
+	var manifest Manifest
+	var size int64
+
+	for i, item := range targets {
+		info, err := os.Stat(filepath.Join(root, item))
+		if err != nil {
+			return errors.Wrap(err, "failed to stat target\n")
+		}
+		if err := copyFile(filepath.Join(root, item), filepath.Join(tmp, strconv.Itoa(i)), info.Mode()); err != nil {
+			return errors.Wrap(err, "failed to store "+item+"\n")
+		}
+		manifest.Outputs = append(manifest.Outputs, Output{Path: item, Size: info.Size(), Mode: info.Mode()})
+		size += info.Size()
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest\n")
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, manifestName), buf, 0644); err != nil {
+		return errors.Wrap(err, "failed to write manifest\n")
+	}
+
+	if err := os.Rename(tmp, c.entryDir(key)); err != nil {
+		if _, statErr := os.Stat(c.entryDir(key)); statErr == nil {
+			return nil
+		}
+		return errors.Wrap(err, "failed to commit entry\n")
+	}
+
+	c.mutex.Lock()
+	c.size += size + int64(len(buf))
+	over := c.cfg.MaxSize > 0 && c.size > c.cfg.MaxSize
+	c.mutex.Unlock()
+
+	if over {
+		if err := c.evict(); err != nil {
+			return errors.Wrap(err, "failed to evict\n")
+		}
+	}
+
+	return nil
+}
+
+func (c *cache) Stats(_ context.Context) (*Stats, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list entries\n")
+	}
+
+	stats := &Stats{
+		Dir:     c.cfg.Dir,
+		Entries: len(entries),
+		MaxSize: c.cfg.MaxSize,
+	}
+
+	for _, item := range entries {
+		stats.Size += item.size
+	}
+
+	return stats, nil
+}
+
+func (c *cache) Clean(_ context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(c.cfg.Dir, actionDir)); err != nil {
+		return errors.Wrap(err, "failed to remove cache\n")
+	}
+
+	c.size, c.known = 0, true
+
+	return nil
+}
+
+func (c *cache) entryDir(key string) string {
+	return filepath.Join(c.cfg.Dir, actionDir, key)
+}
+
+// load sizes the cache once per run
+func (c *cache) load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.known {
+		return nil
+	}
+
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range entries {
+		c.size += item.size
+	}
+
+	c.known = true
+
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits in its size cap
+func (c *cache) evict() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atime.Before(entries[j].atime)
+	})
+
+	c.size = 0
+	for _, item := range entries {
+		c.size += item.size
+	}
+
+	for _, item := range entries {
+		if c.size <= c.cfg.MaxSize {
+			break
+		}
+		if err := os.RemoveAll(c.entryDir(item.key)); err != nil {
+			return errors.Wrap(err, "failed to remove entry\n")
+		}
+		c.size -= item.size
+	}
+
+	return nil
+}
+
+func (c *cache) entries() ([]entry, error) {
+	var buf []entry
+
+	dirs, err := os.ReadDir(filepath.Join(c.cfg.Dir, actionDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read dir\n")
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), tempPrefix) {
+			continue
+		}
+		manifest, err := os.Stat(filepath.Join(c.entryDir(dir.Name()), manifestName))
+		if err != nil {
+			continue
+		}
+		files, err := os.ReadDir(c.entryDir(dir.Name()))
+		if err != nil {
+			continue
+		}
+		e := entry{key: dir.Name(), atime: manifest.ModTime()}
+		for _, file := range files {
+			if info, err := file.Info(); err == nil {
+				e.size += info.Size()
+			}
+		}
+		buf = append(buf, e)
+	}
+
+	return buf, nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file\n")
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(in)
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to make directory\n")
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return errors.Wrap(err, "failed to create file\n")
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return errors.Wrap(err, "failed to copy file\n")
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initCacheTest(t *testing.T, size int64) (Cache, string) {
+	cfg := DefaultConfig()
+	cfg.Dir = t.TempDir()
+	cfg.MaxSize = size
+
+	return New(context.Background(), cfg), t.TempDir()
+}
+
+func TestKey(t *testing.T) {
+	inputs := []Input{{Path: "a.c", Checksum: "1"}, {Path: "a.h", Checksum: "2"}}
+	key := Key("clang  -c a.c", inputs, []string{"a.o"})
+
+	assert.Equal(t, key, Key("clang -c a.c", []Input{inputs[1], inputs[0]}, []string{"a.o"}))
+	assert.NotEqual(t, key, Key("clang -c a.c", []Input{{Path: "a.c", Checksum: "3"}, inputs[1]}, []string{"a.o"}))
+	assert.NotEqual(t, key, Key("clang -c a.c", inputs, []string{"b.o"}))
+}
+
+func TestParseSize(t *testing.T) {
+	size, err := ParseSize("10G")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(10<<30), size)
+
+	size, err = ParseSize("1.5mb")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(3<<19), size)
+
+	_, err = ParseSize("big")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGetPut(t *testing.T) {
+	ctx := context.Background()
+	c, root := initCacheTest(t, 1<<20)
+
+	_ = os.MkdirAll(filepath.Join(root, "out"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(root, "out", "a.o"), []byte("object"), 0755)
+
+	hit, err := c.Get(ctx, "key", root)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, hit)
+
+	err = c.Put(ctx, "key", root, []string{"out/a.o"})
+	assert.Equal(t, nil, err)
+
+	_ = os.RemoveAll(filepath.Join(root, "out"))
+
+	hit, err = c.Get(ctx, "key", root)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, hit)
+
+	buf, err := os.ReadFile(filepath.Join(root, "out", "a.o"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "object", string(buf))
+
+	stats, err := c.Stats(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, stats.Entries)
+
+	err = c.Clean(ctx)
+	assert.Equal(t, nil, err)
+
+	stats, _ = c.Stats(ctx)
+	assert.Equal(t, 0, stats.Entries)
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	c, root := initCacheTest(t, 300)
+
+	_ = os.WriteFile(filepath.Join(root, "a.o"), make([]byte, 100), 0644)
+
+	for _, key := range []string{"k1", "k2"} {
+		err := c.Put(ctx, key, root, []string{"a.o"})
+		assert.Equal(t, nil, err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(filepath.Join(c.(*cache).entryDir("k2"), manifestName), old, old)
+
+	hit, _ := c.Get(ctx, "k1", root)
+	assert.Equal(t, true, hit)
+
+	err := c.Put(ctx, "k3", root, []string{"a.o"})
+	assert.Equal(t, nil, err)
+
+	hit, _ = c.Get(ctx, "k2", root)
+	assert.Equal(t, false, hit)
+
+	hit, _ = c.Get(ctx, "k1", root)
+	assert.Equal(t, true, hit)
+}
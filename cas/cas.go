@@ -0,0 +1,263 @@
+package cas
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"distbuild/boong/proxy/proto"
+	"distbuild/boong/utils"
+)
+
+const (
+	chunkSize = 1024 * 1024
+)
+
+// Digester computes file digests once per run
+type Digester struct {
+	root    string
+	mutex   sync.Mutex
+	digests map[string]*proto.Digest
+}
+
+// Uploader tracks the digests already present on one worker
+type Uploader struct {
+	client   proto.AssetServiceClient
+	digester *Digester
+	mutex    sync.Mutex
+	present  map[string]bool
+}
+
+func NewDigester(root string) *Digester {
+	return &Digester{
+		root:    root,
+		digests: map[string]*proto.Digest{},
+	}
+}
+
+func NewUploader(client proto.AssetServiceClient, digester *Digester) *Uploader {
+	return &Uploader{
+		client:   client,
+		digester: digester,
+		present:  map[string]bool{},
+	}
+}
+
+// IsUnimplemented reports whether the worker has no asset service
+func IsUnimplemented(err error) bool {
+	return status.Code(errors.Cause(err)) == codes.Unimplemented
+}
+
+// Digest returns the digest of name relative to the digester root
+func (d *Digester) Digest(name string) (*proto.Digest, error) {
+	d.mutex.Lock()
+	digest, ok := d.digests[name]
+	d.mutex.Unlock()
+
+	if ok {
+		return digest, nil
+	}
+
+	p := filepath.Join(d.root, name)
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat file\n")
+	}
+
+	sum, err := utils.Checksum(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to calculate checksum\n")
+	}
+
+	digest = &proto.Digest{
+		Hash: sum,
+		Size: info.Size(),
+	}
+
+	d.mutex.Lock()
+	d.digests[name] = digest
+	d.mutex.Unlock()
+
+	return digest, nil
+}
+
+// Digest returns the digest of name relative to the workspace
+func (u *Uploader) Digest(name string) (*proto.Digest, error) {
+	return u.digester.Digest(name)
+}
+
+// Upload sends the files in names the worker does not have yet
+func (u *Uploader) Upload(ctx context.Context, names []string) error {
+	files := map[string]string{}
+	var digests []*proto.Digest
+
+	for _, item := range names {
+		digest, err := u.digester.Digest(item)
+		if err != nil {
+			return errors.Wrap(err, "failed to get digest\n")
+		}
+		if _, ok := files[digest.Hash]; ok {
+			continue
+		}
+		files[digest.Hash] = item
+		digests = append(digests, digest)
+	}
+
+	u.mutex.Lock()
+	digests = slices.DeleteFunc(digests, func(item *proto.Digest) bool {
+		return u.present[item.Hash]
+	})
+	u.mutex.Unlock()
+
+	if len(digests) == 0 {
+		return nil
+	}
+
+	reply, err := u.client.FindMissing(ctx, &proto.FindMissingRequest{Digests: digests})
+	if err != nil {
+		return errors.Wrap(err, "failed to find missing\n")
+	}
+
+	if missing := reply.GetDigests(); len(missing) > 0 {
+		if err := u.upload(ctx, missing, files); err != nil {
+			return errors.Wrap(err, "failed to upload\n")
+		}
+	}
+
+	u.mutex.Lock()
+	for _, item := range digests {
+		u.present[item.Hash] = true
+	}
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func (u *Uploader) upload(ctx context.Context, digests []*proto.Digest, files map[string]string) error {
+	stream, err := u.client.Upload(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to open stream\n")
+	}
+
+	buf := make([]byte, chunkSize)
+
+	for _, item := range digests {
+		name, ok := files[item.GetHash()]
+		if !ok {
+			return errors.New("unknown digest " + item.GetHash() + "\n")
+		}
+		if err := u.send(stream, item, filepath.Join(u.digester.root, name), buf); err != nil {
+			return errors.Wrap(err, "failed to send "+name+"\n")
+		}
+	}
+
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return errors.Wrap(err, "failed to close stream\n")
+	}
+
+	return nil
+}
+
+func (u *Uploader) send(stream proto.AssetService_UploadClient, digest *proto.Digest, name string, buf []byte) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file\n")
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var offset int64
+
+	for {
+		n, err := file.Read(buf)
+		if n > 0 || offset == 0 {
+			req := &proto.UploadRequest{
+				Digest: digest,
+				Offset: offset,
+				Data:   buf[:n],
+			}
+			if err := stream.Send(req); err != nil {
+				return errors.Wrap(err, "failed to send request\n")
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file\n")
+		}
+	}
+
+	return nil
+}
+
+// GetActionResult looks up key in the shared action cache, returning nil on a miss
+func GetActionResult(ctx context.Context, client proto.AssetServiceClient, key string) (*proto.ActionResult, error) {
+	result, err := client.GetActionResult(ctx, &proto.GetActionResultRequest{ActionKey: key})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to get action result\n")
+	}
+
+	return result, nil
+}
+
+// Download writes the blob of digest to name and verifies its checksum
+func Download(ctx context.Context, client proto.AssetServiceClient, digest *proto.Digest, name string, mode os.FileMode) error {
+	stream, err := client.Download(ctx, &proto.DownloadRequest{Digest: digest})
+	if err != nil {
+		return errors.Wrap(err, "failed to open stream\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to make directory\n")
+	}
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file\n")
+	}
+
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = file.Close()
+			return errors.Wrap(err, "failed to receive reply\n")
+		}
+		if _, err := file.WriteAt(reply.GetData(), reply.GetOffset()); err != nil {
+			_ = file.Close()
+			return errors.Wrap(err, "failed to write file\n")
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file\n")
+	}
+
+	sum, err := utils.Checksum(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate checksum\n")
+	}
+
+	if sum != digest.GetHash() {
+		return errors.New("checksum mismatch\n")
+	}
+
+	return nil
+}
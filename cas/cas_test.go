@@ -0,0 +1,191 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"distbuild/boong/proxy/proto"
+)
+
+type assetServer struct {
+	proto.UnimplementedAssetServiceServer
+	mutex sync.Mutex
+	blobs map[string][]byte
+	finds int
+}
+
+func (s *assetServer) FindMissing(_ context.Context, req *proto.FindMissingRequest) (*proto.FindMissingReply, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.finds++
+
+	var missing []*proto.Digest
+	for _, item := range req.GetDigests() {
+		if _, ok := s.blobs[item.GetHash()]; !ok {
+			missing = append(missing, item)
+		}
+	}
+
+	return &proto.FindMissingReply{Digests: missing}, nil
+}
+
+func (s *assetServer) Upload(stream proto.AssetService_UploadServer) error {
+	var digests []*proto.Digest
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		if req.GetOffset() == 0 {
+			digests = append(digests, req.GetDigest())
+			s.blobs[req.GetDigest().GetHash()] = nil
+		}
+		s.blobs[req.GetDigest().GetHash()] = append(s.blobs[req.GetDigest().GetHash()], req.GetData()...)
+		s.mutex.Unlock()
+	}
+
+	return stream.SendAndClose(&proto.UploadReply{Digests: digests})
+}
+
+func (s *assetServer) GetActionResult(_ context.Context, req *proto.GetActionResultRequest) (*proto.ActionResult, error) {
+	if req.GetActionKey() != "key" {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+
+	var outputs []*proto.OutputFile
+	for hash, data := range s.blobs {
+		outputs = append(outputs, &proto.OutputFile{FilePath: "out/a.o", Digest: &proto.Digest{Hash: hash, Size: int64(len(data))}})
+	}
+
+	return &proto.ActionResult{OutputFiles: outputs}, nil
+}
+
+func (s *assetServer) Download(req *proto.DownloadRequest, stream proto.AssetService_DownloadServer) error {
+	data := s.blobs[req.GetDigest().GetHash()]
+
+	for offset := 0; offset < len(data); offset += 4 {
+		end := min(offset+4, len(data))
+		if err := stream.Send(&proto.DownloadReply{Offset: int64(offset), Data: data[offset:end]}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func initCasTest(t *testing.T, server proto.AssetServiceServer) proto.AssetServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+
+	s := grpc.NewServer()
+	proto.RegisterAssetServiceServer(s, server)
+
+	go func() {
+		_ = s.Serve(listener)
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Equal(t, nil, err)
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		s.Stop()
+	})
+
+	return proto.NewAssetServiceClient(conn)
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	large := bytes.Repeat([]byte("x"), chunkSize+10)
+
+	_ = os.WriteFile(filepath.Join(dir, "a.h"), []byte("a"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "b.h"), []byte("a"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "c.o"), large, os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "d.h"), nil, os.ModePerm)
+
+	server := &assetServer{blobs: map[string][]byte{}}
+	u := NewUploader(initCasTest(t, server), NewDigester(dir))
+
+	err := u.Upload(ctx, []string{"a.h", "b.h", "c.o", "d.h"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(server.blobs))
+
+	digest, err := u.Digest("c.o")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(len(large)), digest.Size)
+	assert.Equal(t, large, server.blobs[digest.Hash])
+
+	err = u.Upload(ctx, []string{"a.h", "c.o"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, server.finds)
+}
+
+func TestUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	_ = os.WriteFile(filepath.Join(dir, "a.h"), []byte("a"), os.ModePerm)
+
+	u := NewUploader(initCasTest(t, &proto.UnimplementedAssetServiceServer{}), NewDigester(dir))
+
+	err := u.Upload(ctx, []string{"a.h"})
+	assert.Equal(t, true, IsUnimplemented(err))
+}
+
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	_ = os.WriteFile(filepath.Join(dir, "a.o"), []byte("0123456789"), os.ModePerm)
+
+	server := &assetServer{blobs: map[string][]byte{}}
+	client := initCasTest(t, server)
+
+	err := NewUploader(client, NewDigester(dir)).Upload(ctx, []string{"a.o"})
+	assert.Equal(t, nil, err)
+
+	result, err := GetActionResult(ctx, client, "missing")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*proto.ActionResult)(nil), result)
+
+	result, err = GetActionResult(ctx, client, "key")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(result.GetOutputFiles()))
+
+	name := filepath.Join(dir, "out", "a.o")
+
+	err = Download(ctx, client, result.GetOutputFiles()[0].GetDigest(), name, 0644)
+	assert.Equal(t, nil, err)
+
+	buf, err := os.ReadFile(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0123456789", string(buf))
+
+	err = Download(ctx, client, &proto.Digest{Hash: "bad"}, name, 0644)
+	assert.NotEqual(t, nil, err)
+}
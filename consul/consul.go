@@ -1,29 +1,91 @@
 package consul
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var (
-	listenAddresses []string
+const (
+	// DefaultPort is the port of workers registered without one
+	DefaultPort = 39090
+
+	// watchWait is how long a blocking query waits for a change
+	watchWait = 5 * time.Minute
+	// watchBackoff is the longest pause between failed blocking queries
+	watchBackoff = time.Minute
 )
 
+// Consul lists the build workers registered in a Consul agent
+type Consul interface {
+	// Init checks the config, parses the admission policy and loads the TLS files
+	Init(context.Context) error
+	// Workers lists the passing workers of the first datacenter having any
+	Workers(context.Context) ([]Worker, error)
+	// Watch signals whenever the workers may have changed, until ctx is done
+	Watch(context.Context) <-chan struct{}
+}
+
+// Config of the Consul agent at Address and of the worker service, every passing
+// service with Tags is a worker service when Service is empty, one of them must be
+// set. FallbackDatacenters are asked
+// in order when Datacenter, the agent's own when empty, has no workers, and Policy
+// is the admission policy of workers as parsed by ParsePolicy
+type Config struct {
+	Address             string
+	Scheme              string
+	Port                int
+	CAFile              string
+	CertFile            string
+	KeyFile             string
+	Token               string
+	Datacenter          string
+	FallbackDatacenters []string
+	Service             string
+	Tags                []string
+	Policy              string
+}
+
+type client struct {
+	cfg        *Config
+	httpClient *http.Client
+	policy     *Policy
+}
+
 type NormalService struct {
 	Name string `json:"ServiceName"`
 }
 
+// ServiceEntry is an instance of a service along with the node it runs on
+type ServiceEntry struct {
+	Node    ServiceNode   `json:"Node"`
+	Service ConsulService `json:"Service"`
+}
+
+type ServiceNode struct {
+	Address string `json:"Address"`
+}
+
 type ConsulService struct {
-	Address string      `json:"ServiceAddress"`
-	Meta    ServiceMeta `json:"ServiceMeta"`
+	Address string      `json:"Address"`
+	Port    int         `json:"Port"`
+	Tags    []string    `json:"Tags"`
+	Meta    ServiceMeta `json:"Meta"`
 }
 
 type ServiceMeta struct {
@@ -33,11 +95,86 @@ type ServiceMeta struct {
 	Memory       string `json:"memory"`
 }
 
+type Worker struct {
+	Address string
+	Meta    ServiceMeta
+}
+
 type Disk struct {
 	Name string `json:"name"`
 	Size string `json:"size"`
 }
 
+func New(_ context.Context, cfg *Config) Consul {
+	return &client{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 20 * time.Second},
+	}
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Scheme: "http",
+		Port:   8500,
+		Policy: DefaultPolicy,
+	}
+}
+
+func (c *client) Init(_ context.Context) error {
+	if c.cfg.Scheme != "http" && c.cfg.Scheme != "https" {
+		return fmt.Errorf("invalid consul scheme %s", c.cfg.Scheme)
+	}
+
+	if c.cfg.Service == "" && len(c.cfg.Tags) == 0 {
+		return errors.New("consul worker service or tags required")
+	}
+
+	policy, err := ParsePolicy(c.cfg.Policy)
+	if err != nil {
+		return err
+	}
+
+	c.policy = policy
+
+	if c.cfg.CAFile == "" && c.cfg.CertFile == "" && c.cfg.KeyFile == "" {
+		return nil
+	}
+
+	if c.cfg.Scheme != "https" {
+		return errors.New("consul TLS files need the https scheme")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.cfg.CAFile != "" {
+		data, err := os.ReadFile(c.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read consul CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in consul CA %s", c.cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.cfg.CertFile != "" || c.cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load consul client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.httpClient.Transport = transport
+
+	return nil
+}
+
 func containsAny(listB, listA []string) bool {
 	for _, a := range listA {
 		if slices.Contains(listB, a) {
@@ -66,86 +203,127 @@ func fetchCompileDiskSize(disksInfo string) (string, error) {
 	return "", fmt.Errorf("failed to get compile disk size")
 }
 
-func isDiskSizeEnough(disksInfo string) bool {
-	homeCapacityInfo, err := fetchCompileDiskSize(disksInfo)
-	if err != nil {
-		return false
-	}
-	sizeSlice := strings.Split(homeCapacityInfo, " ")
-	if len(sizeSlice) >= 2 {
-		sizeUnit := sizeSlice[1]
-		switch sizeUnit {
-		case "GB":
-			num, err := strconv.Atoi(sizeSlice[0])
-			if err != nil {
-				return false
-			}
-			if num >= 500 {
-				return true
-			} else {
-				return false
-			}
-		case "TB":
-			return true
-		default:
-			return false
-		}
+// Cores returns the number of cpu cores in meta, 0 if unknown
+func (m ServiceMeta) Cores() int {
+	fields := strings.Fields(m.CPU)
+	if len(fields) == 0 {
+		return 0
 	}
-	return false
+	num, err := strconv.Atoi(fields[0])
+	if err != nil || num < 0 {
+		return 0
+	}
+	return num
 }
 
 func isValidIP(ip string) bool {
 	return net.ParseIP(ip) != nil
 }
 
-func getListenAddress(consulIp, service string) ([]string, error) {
-	url := fmt.Sprintf("http://%s:8500/v1/catalog/service/%s", consulIp, service)
-	client := &http.Client{Timeout: 20 * time.Second}
+// hasTags reports whether tags holds every required tag
+func hasTags(tags, required []string) bool {
+	for _, item := range required {
+		if !slices.Contains(tags, item) {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceURL lists the instances of service passing all of their checks and carrying every tag
+func (c *client) serviceURL(dc, service string) string {
+	query := url.Values{}
+	query.Set("passing", "true")
+	for _, item := range c.cfg.Tags {
+		query.Add("tag", item)
+	}
+
+	return c.url(dc, "health/service/"+url.PathEscape(service), query)
+}
 
-	resp, err := client.Get(url)
+// listen returns the passing workers of one service, skipping those not carrying every tag
+func (c *client) listen(ctx context.Context, dc, service string) ([]Worker, error) {
+	body, err := c.get(ctx, c.serviceURL(dc, service))
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
-	body, err := io.ReadAll(resp.Body)
+	var entries []ServiceEntry
+	err = json.Unmarshal(body, &entries)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid response status code: %d", resp.StatusCode)
+	var workers []Worker
+	for _, entry := range entries {
+		service := entry.Service
+
+		// services registered without an address are reached at the address of their node
+		address := service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		if !isValidIP(address) || !hasTags(service.Tags, c.cfg.Tags) {
+			continue
+		}
+
+		if reasons := c.policy.Check(service.Meta, time.Now()); len(reasons) != 0 {
+			log.Printf("Skipping worker %s: %s\n", address, strings.Join(reasons, "; "))
+			continue
+		}
+
+		port := service.Port
+		if port == 0 {
+			port = DefaultPort
+		}
+
+		workers = append(workers, Worker{
+			Address: net.JoinHostPort(address, strconv.Itoa(port)),
+			Meta:    service.Meta,
+		})
+	}
+
+	return workers, nil
+}
+
+// services returns the names of the services with passing checks, only the worker
+// service when one is configured
+func (c *client) services(ctx context.Context, dc string) ([]string, error) {
+	body, err := c.get(ctx, c.url(dc, "health/state/passing", nil))
+	if err != nil {
+		return nil, err
 	}
 
-	var services []ConsulService
+	var services []NormalService
 	err = json.Unmarshal(body, &services)
 	if err != nil {
 		return nil, err
 	}
 
-	var addresses []string
+	var servicesList []string
 	for _, service := range services {
-		// Is diskSizeEnough：available Capacity > 500GB
-		diskSizeEnough := isDiskSizeEnough(service.Meta.Disks)
-
-		// if !isValidIP(service.Address) || !dataValid || !diskSizeEnough {
-		if !isValidIP(service.Address) || !diskSizeEnough {
+		if len(service.Name) == 0 || slices.Contains(servicesList, service.Name) {
 			continue
 		}
-		addresses = append(addresses, fmt.Sprintf("%s:%d", service.Address, 39090))
+		if len(c.cfg.Service) != 0 && service.Name != c.cfg.Service {
+			continue
+		}
+		servicesList = append(servicesList, service.Name)
 	}
 
-	return addresses, nil
+	log.Printf("worker services of datacenter %s: %s\n", datacenterName(dc), strings.Join(servicesList, ", "))
+
+	return servicesList, nil
 }
 
-func getNormalConsulServices(consulIp string) ([]string, error) {
-	url := fmt.Sprintf("http://%s:8500/v1/health/state/passing", consulIp)
-	client := &http.Client{Timeout: 20 * time.Second}
+func (c *client) get(ctx context.Context, endpoint string) ([]byte, error) {
+	req, err := c.request(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := client.Get(url)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -163,38 +341,241 @@ func getNormalConsulServices(consulIp string) ([]string, error) {
 		return nil, fmt.Errorf("invalid consul server response status code: %d", resp.StatusCode)
 	}
 
-	var services []NormalService
-	err = json.Unmarshal(body, &services)
+	return body, nil
+}
+
+// request builds a request to the agent, carrying the ACL token if there is one
+func (c *client) request(ctx context.Context, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var servicesList []string
-	for _, service := range services {
-		if len(service.Name) > 0 {
-			servicesList = append(servicesList, service.Name)
+	if c.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", c.cfg.Token)
+	}
+
+	return req, nil
+}
+
+// url of an API path in datacenter dc, the agent's own when empty
+func (c *client) url(dc, path string, query url.Values) string {
+	query = maps.Clone(query)
+	if dc != "" {
+		if query == nil {
+			query = url.Values{}
 		}
+		query.Set("dc", dc)
 	}
 
-	return servicesList, nil
+	ret := fmt.Sprintf("%s://%s/v1/%s", c.cfg.Scheme, net.JoinHostPort(c.cfg.Address, strconv.Itoa(c.cfg.Port)), path)
+	if len(query) != 0 {
+		ret += "?" + query.Encode()
+	}
+	return ret
 }
 
-func GetListenAddresses(consulServiceIp string) ([]string, error) {
-	listenAddresses = []string{}
-	servicesList, err := getNormalConsulServices(consulServiceIp)
+// datacenters returns the configured datacenter and then the fallback ones
+func (c *client) datacenters() []string {
+	return append([]string{c.cfg.Datacenter}, c.cfg.FallbackDatacenters...)
+}
+
+func (c *client) Workers(ctx context.Context) ([]Worker, error) {
+	var err error
+
+	for _, dc := range c.datacenters() {
+		var workers []Worker
+		if workers, err = c.workers(ctx, dc); err != nil {
+			log.Printf("failed to get workers of datacenter %s: %v\n", datacenterName(dc), err)
+			continue
+		}
+		if len(workers) != 0 {
+			return workers, nil
+		}
+		log.Printf("no workers in datacenter %s\n", datacenterName(dc))
+	}
+
+	return nil, err
+}
+
+func datacenterName(dc string) string {
+	if dc == "" {
+		return "(local)"
+	}
+	return dc
+}
+
+func (c *client) workers(ctx context.Context, dc string) ([]Worker, error) {
+	var workers []Worker
+	var listenAddresses []string
+
+	servicesList, err := c.services(ctx, dc)
 	if err != nil {
 		return nil, errors.New("failed to get consul services")
 	}
 
 	for _, service := range servicesList {
-		addresses, err := getListenAddress(consulServiceIp, service)
+		buf, err := c.listen(ctx, dc, service)
 		if err != nil {
 			return nil, errors.New("failed to get worker addresses")
 		}
 
+		var addresses []string
+		for _, item := range buf {
+			addresses = append(addresses, item.Address)
+		}
+
 		if !containsAny(listenAddresses, addresses) {
 			listenAddresses = append(listenAddresses, addresses...)
+			workers = append(workers, buf...)
 		}
 	}
-	return listenAddresses, nil
+	return workers, nil
+}
+
+// GetWorkers returns the workers of every passing service of the Consul agent
+func GetWorkers(consulServiceIp string) ([]Worker, error) {
+	cfg := DefaultConfig()
+	cfg.Address = consulServiceIp
+
+	c := New(context.Background(), cfg)
+
+	if err := c.Init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return c.Workers(context.Background())
+}
+
+func GetListenAddresses(consulServiceIp string) ([]string, error) {
+	workers, err := GetWorkers(consulServiceIp)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, item := range workers {
+		addresses = append(addresses, item.Address)
+	}
+
+	return addresses, nil
+}
+
+// Watch signals whenever the passing instances of the worker service, or the passing
+// health checks and registered services when there is none, of any of the datacenters
+// change, using blocking queries, until ctx is done
+func (c *client) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	signal := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for _, dc := range c.datacenters() {
+		endpoints := []string{c.url(dc, "health/state/passing", nil), c.url(dc, "catalog/services", nil)}
+		if c.cfg.Service != "" {
+			endpoints = []string{c.serviceURL(dc, c.cfg.Service)}
+		}
+		for _, endpoint := range endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.watch(ctx, endpoint, signal)
+			}()
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(changes)
+	}()
+
+	return changes
+}
+
+// watch calls signal each time the index of endpoint changes, backing off on errors
+func (c *client) watch(ctx context.Context, endpoint string, signal func()) {
+	var index uint64
+
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		next, err := c.blockingQuery(ctx, endpoint, index, watchWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("failed to watch %s: %v\n", endpoint, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, watchBackoff)
+			continue
+		}
+
+		backoff = time.Second
+
+		if next != index {
+			signal()
+		}
+
+		// an index going backwards was reset on the server, it starts over
+		switch {
+		case next < index:
+			index = 0
+		case next < 1:
+			index = 1
+		default:
+			index = next
+		}
+	}
+}
+
+// blockingQuery waits until the result of endpoint changes past index, or wait passes,
+// and returns its new index
+func (c *client) blockingQuery(ctx context.Context, endpoint string, index uint64, wait time.Duration) (uint64, error) {
+	req, err := c.request(ctx, endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	query := req.URL.Query()
+	query.Set("index", strconv.FormatUint(index, 10))
+	query.Set("wait", wait.String())
+	req.URL.RawQuery = query.Encode()
+
+	// consul adds up to wait/16 of jitter to the wait
+	client := &http.Client{
+		Transport: c.httpClient.Transport,
+		Timeout:   wait + wait/16 + 20*time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("invalid response status code: %d", resp.StatusCode)
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid consul index: %v", err)
+	}
+
+	return next, nil
 }
@@ -1 +1,244 @@
 package consul
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCores(t *testing.T) {
+	assert.Equal(t, 16, ServiceMeta{CPU: "16"}.Cores())
+	assert.Equal(t, 8, ServiceMeta{CPU: "8 cores"}.Cores())
+	assert.Equal(t, 0, ServiceMeta{CPU: ""}.Cores())
+	assert.Equal(t, 0, ServiceMeta{CPU: "unknown"}.Cores())
+}
+
+func TestBlockingQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "5s", r.URL.Query().Get("wait"))
+		index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index+1))
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	c := New(context.Background(), DefaultConfig()).(*client)
+
+	index, err := c.blockingQuery(context.Background(), server.URL, 41, 5*time.Second)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(42), index)
+}
+
+func TestWatch(t *testing.T) {
+	var mutex sync.Mutex
+	var indexes []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		indexes = append(indexes, r.URL.Query().Get("index"))
+		mutex.Unlock()
+		// the index moves to 7, then to 9
+		index := "7"
+		if r.URL.Query().Get("index") == "7" {
+			index = "9"
+		}
+		w.Header().Set("X-Consul-Index", index)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := New(context.Background(), DefaultConfig()).(*client)
+
+	signals := 0
+	c.watch(ctx, server.URL, func() {
+		signals++
+		if signals == 2 {
+			cancel()
+		}
+	})
+
+	assert.Equal(t, 2, signals)
+
+	mutex.Lock()
+	assert.Equal(t, []string{"0", "7"}, indexes[:2])
+	mutex.Unlock()
+}
+
+// agentTransport sends every request to the test agent
+type agentTransport struct {
+	server *httptest.Server
+}
+
+func (a *agentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = a.server.Listener.Addr().String()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func initConsulTest(t *testing.T, cfg *Config) Consul {
+	disks := `[{"name": "/home", "size": "1 TB"}]`
+	small := `[{"name": "/home", "size": "300 GB"}]`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/health/state/passing":
+			_, _ = w.Write([]byte(`[{"ServiceName": "worker"}, {"ServiceName": "worker"}, {"ServiceName": "web"}, {"ServiceName": ""}]`))
+		case "/v1/health/service/worker":
+			assert.Equal(t, cfg.Tags, r.URL.Query()["tag"])
+			assert.Equal(t, "true", r.URL.Query().Get("passing"))
+			_, _ = fmt.Fprintf(w, `[
+{"Node": {"Address": "10.0.9.1"}, "Service": {"Address": "10.0.0.1", "Port": 40000, "Tags": ["build"], "Meta": {"disks": %q}}},
+{"Node": {"Address": "10.0.9.2"}, "Service": {"Address": "fd00::2", "Tags": ["build"], "Meta": {"disks": %q}}},
+{"Node": {"Address": "10.0.0.3"}, "Service": {"Address": "", "Port": 40000, "Tags": ["build"], "Meta": {"disks": %q}}},
+{"Node": {"Address": "10.0.9.4"}, "Service": {"Address": "10.0.0.4", "Port": 40000, "Meta": {"disks": %q}}},
+{"Node": {"Address": "10.0.9.5"}, "Service": {"Address": "10.0.0.5", "Port": 40000, "Tags": ["build"], "Meta": {"disks": %q}}}
+]`, disks, disks, disks, disks, small)
+		case "/v1/health/service/web":
+			_, _ = fmt.Fprintf(w, `[{"Node": {"Address": "10.0.9.6"}, "Service": {"Address": "10.0.1.1", "Port": 80, "Meta": {"disks": %q}}}]`, disks)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	c := New(context.Background(), cfg).(*client)
+
+	err := c.Init(context.Background())
+	assert.Equal(t, nil, err)
+
+	c.httpClient.Transport = &agentTransport{server: server}
+
+	return c
+}
+
+func TestWorkers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Service = "worker"
+	cfg.Tags = []string{"build"}
+
+	workers, err := initConsulTest(t, cfg).Workers(context.Background())
+	assert.Equal(t, nil, err)
+
+	var addresses []string
+	for _, item := range workers {
+		addresses = append(addresses, item.Address)
+	}
+
+	assert.Equal(t, []string{"10.0.0.1:40000", "[fd00::2]:39090", "10.0.0.3:40000"}, addresses)
+
+	// without a service every passing service with the tags is a worker service
+	cfg = DefaultConfig()
+	cfg.Address = "127.0.0.1"
+	cfg.Tags = []string{"build"}
+
+	workers, err = initConsulTest(t, cfg).Workers(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(workers))
+
+	cfg = DefaultConfig()
+	cfg.Address = "127.0.0.1"
+
+	err = New(context.Background(), cfg).Init(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDatacenters(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// dc1 has no passing workers, dc2 has one
+		dc := r.URL.Query().Get("dc")
+		switch {
+		case r.URL.Path == "/v1/health/state/passing" && dc == "dc2":
+			_, _ = w.Write([]byte(`[{"ServiceName": "worker"}]`))
+		case r.URL.Path == "/v1/health/state/passing":
+			_, _ = w.Write([]byte(`[]`))
+		case r.URL.Path == "/v1/health/service/worker" && dc == "dc2":
+			_, _ = w.Write([]byte(`[{"Node": {"Address": "10.0.9.1"}, "Service": {"Address": "10.0.2.1", "Port": 40000, "Meta": {"disks": "[{\"name\": \"/\", \"size\": \"2 TB\"}]"}}}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	assert.Equal(t, nil, err)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Equal(t, nil, err)
+
+	cfg := DefaultConfig()
+	cfg.Address = host
+	cfg.Port, _ = strconv.Atoi(port)
+	cfg.Scheme = "https"
+	cfg.CAFile = ca
+	cfg.Token = "secret"
+	cfg.Datacenter = "dc1"
+	cfg.FallbackDatacenters = []string{"dc2"}
+	cfg.Service = "worker"
+
+	c := New(context.Background(), cfg)
+
+	err = c.Init(context.Background())
+	assert.Equal(t, nil, err)
+
+	workers, err := c.Workers(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(workers))
+	assert.Equal(t, "10.0.2.1:40000", workers[0].Address)
+
+	cfg.Scheme = "http"
+	err = New(context.Background(), cfg).Init(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPolicy(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	meta := ServiceMeta{
+		CreationTime: "2024-05-01T00:00:00Z",
+		CPU:          "32",
+		Disks:        `[{"name": "/", "size": "1.5 tb"}]`,
+		Memory:       "128GB",
+	}
+
+	p, err := ParsePolicy("disk>=500GB, cpu >= 16, memory>=64gb, age<=45d")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(p.Check(meta, now)))
+
+	p, err = ParsePolicy("disk>=2TB,cpu>32,age<720h")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{
+		"disk>=2TB: disk is 1500GB",
+		"cpu>32: cpu is 32",
+		"age<720h: age is 744h0m0s",
+	}, p.Check(meta, now))
+
+	p, err = ParsePolicy(DefaultPolicy)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"disk>=500GB: disk is 499.5GB"}, p.Check(ServiceMeta{Disks: `[{"name": "/home", "size": "499500 MB"}]`}, now))
+	assert.Equal(t, []string{"disk>=500GB: unknown disk size"}, p.Check(ServiceMeta{}, now))
+	assert.Equal(t, 0, len(p.Check(ServiceMeta{Disks: `[{"name": "/home", "size": "0.001 PB"}]`}, now)))
+
+	for _, item := range []string{"disk>=500XB", "gpu>=1", "cpu", "age<=soon"} {
+		_, err = ParsePolicy(item)
+		assert.NotEqual(t, nil, err, item)
+	}
+}
@@ -0,0 +1,246 @@
+package consul
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPolicy admits workers with at least 500GB on their compile disk
+	DefaultPolicy = "disk>=500GB"
+)
+
+var (
+	// sizeUnits are decimal, matched case-insensitively with or without the trailing B
+	sizeUnits = map[string]float64{
+		"":  1,
+		"K": 1e3,
+		"M": 1e6,
+		"G": 1e9,
+		"T": 1e12,
+		"P": 1e15,
+	}
+
+	policyOps = []string{">=", "<=", "!=", "==", ">", "<"}
+)
+
+// Policy admits workers whose ServiceMeta satisfies all of its rules
+type Policy struct {
+	rules []policyRule
+}
+
+// policyRule compares one ServiceMeta field, sizes in bytes and ages in seconds
+type policyRule struct {
+	field string
+	op    string
+	value float64
+	text  string
+}
+
+// ParsePolicy parses comma separated rules such as "disk>=500GB, cpu>=16, memory>=64GB, age<=30d"
+// over the fields disk, cpu, memory and age, an empty policy admits every worker
+func ParsePolicy(expr string) (*Policy, error) {
+	p := &Policy{}
+
+	for _, item := range strings.Split(expr, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		rule, err := parseRule(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %v", item, err)
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+func parseRule(item string) (policyRule, error) {
+	for _, op := range policyOps {
+		i := strings.Index(item, op)
+		if i < 0 {
+			continue
+		}
+
+		rule := policyRule{
+			field: strings.ToLower(strings.TrimSpace(item[:i])),
+			op:    op,
+			text:  item,
+		}
+
+		value := strings.TrimSpace(item[i+len(op):])
+
+		var err error
+
+		switch rule.field {
+		case "disk", "memory":
+			rule.value, err = parseSize(value)
+		case "cpu":
+			rule.value, err = strconv.ParseFloat(value, 64)
+		case "age":
+			rule.value, err = parseAge(value)
+		default:
+			return rule, fmt.Errorf("unknown field %s", rule.field)
+		}
+
+		return rule, err
+	}
+
+	return policyRule{}, fmt.Errorf("missing operator")
+}
+
+// Check returns the reasons meta is rejected, none when it is admitted
+func (p *Policy) Check(meta ServiceMeta, now time.Time) []string {
+	if p == nil {
+		return nil
+	}
+
+	var reasons []string
+
+	for _, rule := range p.rules {
+		actual, err := rule.actual(meta, now)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", rule.text, err))
+			continue
+		}
+		if !rule.compare(actual) {
+			reasons = append(reasons, fmt.Sprintf("%s: %s is %s", rule.text, rule.field, formatValue(rule.field, actual)))
+		}
+	}
+
+	return reasons
+}
+
+func (r *policyRule) actual(meta ServiceMeta, now time.Time) (float64, error) {
+	switch r.field {
+	case "disk":
+		size, err := fetchCompileDiskSize(meta.Disks)
+		if err != nil {
+			return 0, fmt.Errorf("unknown disk size")
+		}
+		return parseSize(size)
+	case "memory":
+		if meta.Memory == "" {
+			return 0, fmt.Errorf("unknown memory")
+		}
+		return parseSize(meta.Memory)
+	case "cpu":
+		cores := meta.Cores()
+		if cores == 0 {
+			return 0, fmt.Errorf("unknown cpu")
+		}
+		return float64(cores), nil
+	case "age":
+		created, err := parseTime(meta.CreationTime)
+		if err != nil {
+			return 0, fmt.Errorf("unknown creation time")
+		}
+		return now.Sub(created).Seconds(), nil
+	}
+
+	return 0, fmt.Errorf("unknown field %s", r.field)
+}
+
+func (r *policyRule) compare(actual float64) bool {
+	switch r.op {
+	case ">=":
+		return actual >= r.value
+	case "<=":
+		return actual <= r.value
+	case ">":
+		return actual > r.value
+	case "<":
+		return actual < r.value
+	case "==":
+		return actual == r.value
+	case "!=":
+		return actual != r.value
+	}
+
+	return false
+}
+
+// parseSize parses decimal sizes such as "500 GB", "1.5tb" or "64G" into bytes
+func parseSize(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+
+	num, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(value[i:]))
+	if unit != "B" {
+		unit = strings.TrimSuffix(unit, "B")
+	} else {
+		unit = ""
+	}
+
+	scale, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", value[i:])
+	}
+
+	return num * scale, nil
+}
+
+// parseAge parses a Go duration, or a number of days such as "30d", into seconds
+func parseAge(value string) (float64, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		num, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return num * 24 * 3600, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+
+	return d.Seconds(), nil
+}
+
+// parseTime parses a CreationTime as RFC 3339, a date and time, or unix seconds
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+
+	return time.Unix(sec, 0), nil
+}
+
+func formatValue(field string, value float64) string {
+	switch field {
+	case "disk", "memory":
+		return strconv.FormatFloat(math.Round(value/1e7)/100, 'f', -1, 64) + "GB"
+	case "age":
+		return time.Duration(math.Round(value) * float64(time.Second)).String()
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
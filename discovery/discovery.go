@@ -0,0 +1,295 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distbuild/boong/proxy/consul"
+)
+
+const (
+	// DefaultInterval is how often the file and DNS backends are listed again
+	DefaultInterval = 10 * time.Second
+)
+
+// Discovery finds the workers tasks are sent to
+type Discovery interface {
+	// Workers lists the workers available now
+	Workers(context.Context) ([]Worker, error)
+	// Watch sends the workers joining and leaving since the last listing, until ctx is done
+	Watch(context.Context) <-chan Event
+}
+
+// Worker is a build worker, Cores is 0 when it is unknown
+type Worker struct {
+	Address string
+	Cores   int
+}
+
+type EventType int
+
+const (
+	EventAdd EventType = iota
+	EventRemove
+)
+
+// Event reports a worker joining or leaving the pool
+type Event struct {
+	Type   EventType
+	Worker Worker
+}
+
+// lister lists the workers of a backend
+type lister func(context.Context) ([]Worker, error)
+
+// poller lists a backend again each time changes signals and sends the difference
+// as events, a backend without changes is fixed
+type poller struct {
+	list    lister
+	changes func(context.Context) <-chan struct{}
+	mutex   sync.Mutex
+	known   []Worker
+}
+
+// NewStatic returns the fixed workers of addresses, each of them host:port
+func NewStatic(addresses []string) (Discovery, error) {
+	var workers []Worker
+
+	for _, item := range addresses {
+		if _, _, err := net.SplitHostPort(item); err != nil {
+			return nil, fmt.Errorf("invalid worker address %s: %v", item, err)
+		}
+		workers = append(workers, Worker{Address: item})
+	}
+
+	return &poller{
+		list: func(context.Context) ([]Worker, error) {
+			return workers, nil
+		},
+	}, nil
+}
+
+// NewFile returns the workers listed in a file, read again every interval. Each
+// line is a host:port address optionally followed by its number of cores
+func NewFile(name string, interval time.Duration) Discovery {
+	return &poller{
+		list: func(context.Context) ([]Worker, error) {
+			return readFile(name)
+		},
+		changes: every(interval),
+	}
+}
+
+// NewDNS returns the workers of the SRV records of name, such as _boong._tcp.example.com
+func NewDNS(name string, interval time.Duration) Discovery {
+	return newDNS(name, interval, net.DefaultResolver.LookupSRV)
+}
+
+// NewConsul returns the workers a Consul agent reports, watched with blocking queries
+func NewConsul(ctx context.Context, cfg *consul.Config) (Discovery, error) {
+	c := consul.New(ctx, cfg)
+
+	if err := c.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	return &poller{
+		list: func(ctx context.Context) ([]Worker, error) {
+			buf, err := c.Workers(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var workers []Worker
+			for _, item := range buf {
+				workers = append(workers, Worker{Address: item.Address, Cores: item.Meta.Cores()})
+			}
+			return workers, nil
+		},
+		changes: c.Watch,
+	}, nil
+}
+
+func newDNS(name string, interval time.Duration, lookup func(context.Context, string, string, string) (string, []*net.SRV, error)) Discovery {
+	return &poller{
+		list: func(ctx context.Context) ([]Worker, error) {
+			_, records, err := lookup(ctx, "", "", name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s: %v", name, err)
+			}
+			var workers []Worker
+			for _, item := range records {
+				host := strings.TrimSuffix(item.Target, ".")
+				workers = append(workers, Worker{Address: net.JoinHostPort(host, strconv.Itoa(int(item.Port)))})
+			}
+			return workers, nil
+		},
+		changes: every(interval),
+	}
+}
+
+// every signals each interval, never with a zero interval
+func every(interval time.Duration) func(context.Context) <-chan struct{} {
+	if interval <= 0 {
+		return nil
+	}
+
+	return func(ctx context.Context) <-chan struct{} {
+		ticks := make(chan struct{})
+		go func() {
+			defer close(ticks)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case ticks <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ticks
+	}
+}
+
+func (p *poller) Workers(ctx context.Context) ([]Worker, error) {
+	workers, err := p.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.known = workers
+	p.mutex.Unlock()
+
+	return workers, nil
+}
+
+func (p *poller) Watch(ctx context.Context) <-chan Event {
+	events := make(chan Event)
+
+	if p.changes == nil {
+		go func() {
+			<-ctx.Done()
+			close(events)
+		}()
+		return events
+	}
+
+	changes := p.changes(ctx)
+
+	go func() {
+		defer close(events)
+
+		for {
+			select {
+			case _, ok := <-changes:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			workers, err := p.list(ctx)
+			if err != nil {
+				log.Printf("failed to list workers: %v\n", err)
+				continue
+			}
+
+			p.mutex.Lock()
+			buf := diff(p.known, workers)
+			p.known = workers
+			p.mutex.Unlock()
+
+			for _, item := range buf {
+				select {
+				case events <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+// diff returns the events turning the workers of prev into those of next
+func diff(prev, next []Worker) []Event {
+	var events []Event
+
+	has := func(workers []Worker, address string) bool {
+		return slices.ContainsFunc(workers, func(item Worker) bool {
+			return item.Address == address
+		})
+	}
+
+	for _, item := range prev {
+		if !has(next, item.Address) {
+			events = append(events, Event{Type: EventRemove, Worker: item})
+		}
+	}
+
+	for _, item := range next {
+		if !has(prev, item.Address) {
+			events = append(events, Event{Type: EventAdd, Worker: item})
+		}
+	}
+
+	return events
+}
+
+// readFile parses a worker file, skipping empty lines and # comments
+func readFile(name string) ([]Worker, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var workers []Worker
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid worker address %s: %v", name, line, fields[0], err)
+		}
+		worker := Worker{Address: fields[0]}
+		if len(fields) > 1 {
+			cores, err := strconv.Atoi(fields[1])
+			if err != nil || cores < 0 {
+				return nil, fmt.Errorf("%s:%d: invalid cores %s", name, line, fields[1])
+			}
+			worker.Cores = cores
+		}
+		workers = append(workers, worker)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+
+	return workers, nil
+}
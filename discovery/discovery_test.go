@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatic(t *testing.T) {
+	d, err := NewStatic([]string{"10.0.0.1:39090", "[::1]:39090"})
+	assert.Equal(t, nil, err)
+
+	workers, err := d.Workers(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Worker{{Address: "10.0.0.1:39090"}, {Address: "[::1]:39090"}}, workers)
+
+	_, err = NewStatic([]string{"10.0.0.1"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "workers")
+
+	err := os.WriteFile(name, []byte("# lab\n10.0.0.1:39090 16\n\n10.0.0.2:39090\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	d := NewFile(name, time.Millisecond)
+
+	workers, err := d.Workers(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Worker{{Address: "10.0.0.1:39090", Cores: 16}, {Address: "10.0.0.2:39090"}}, workers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := d.Watch(ctx)
+
+	// replaced at once, so that a listing never sees the file half written
+	err = os.WriteFile(name+".tmp", []byte("10.0.0.2:39090\n10.0.0.3:39090 8\n"), 0644)
+	assert.Equal(t, nil, err)
+	err = os.Rename(name+".tmp", name)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, Event{Type: EventRemove, Worker: Worker{Address: "10.0.0.1:39090", Cores: 16}}, <-events)
+	assert.Equal(t, Event{Type: EventAdd, Worker: Worker{Address: "10.0.0.3:39090", Cores: 8}}, <-events)
+
+	cancel()
+
+	for range events {
+	}
+
+	err = os.WriteFile(name, []byte("10.0.0.1\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	_, err = d.Workers(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDNS(t *testing.T) {
+	lookup := func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_boong._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return name, []*net.SRV{
+			{Target: "worker1.example.com.", Port: 39090},
+			{Target: "worker2.example.com.", Port: 39091},
+		}, nil
+	}
+
+	workers, err := newDNS("_boong._tcp.example.com", 0, lookup).Workers(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Worker{{Address: "worker1.example.com:39090"}, {Address: "worker2.example.com:39091"}}, workers)
+
+	_, err = newDNS("_boong._tcp.example.org", 0, lookup).Workers(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDiff(t *testing.T) {
+	prev := []Worker{{Address: "a:1"}, {Address: "b:1"}}
+	next := []Worker{{Address: "b:1"}, {Address: "c:1"}}
+
+	assert.Equal(t, []Event{
+		{Type: EventRemove, Worker: Worker{Address: "a:1"}},
+		{Type: EventAdd, Worker: Worker{Address: "c:1"}},
+	}, diff(prev, next))
+
+	assert.Equal(t, 0, len(diff(prev, prev)))
+}
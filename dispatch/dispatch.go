@@ -0,0 +1,640 @@
+package dispatch
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"distbuild/boong/proxy/task"
+)
+
+const (
+	maxBackoff = 30 * time.Second
+)
+
+type Dispatcher interface {
+	Run(context.Context, []*Worker, *task.Graph) (*Report, error)
+	RunStream(context.Context, []*Worker, <-chan task.BuildInfo) (*task.Graph, *Report, error)
+}
+
+// Config of the dispatcher, Fallback runs tasks no remote worker could take and
+// Changes adds and drains workers while running. Produced reports whether a task
+// of the stream produces a build file and Exists whether it is on disk, a streamed
+// task waits for the producers of its build files, or fails if there are none and
+// they are not on disk
+type Config struct {
+	KeepGoing bool
+	Retries   int
+	Backoff   time.Duration
+	Retryable func(error) bool
+	Fallback  *Worker
+	Changes   <-chan Change
+	Produced  func(string) bool
+	Exists    func(string) bool
+}
+
+// ExecFunc builds one task and writes its targets into the workspace
+type ExecFunc func(context.Context, *task.BuildInfo) error
+
+type Worker struct {
+	Name  string
+	Slots int
+	Exec  ExecFunc
+}
+
+// Change adds a worker to the pool, or drains the worker of the same name when
+// Remove is set, letting its running tasks finish
+type Change struct {
+	Worker *Worker
+	Remove bool
+}
+
+type Status int
+
+const (
+	StatusPending Status = iota
+	StatusDone
+	StatusFailed
+	StatusSkipped
+)
+
+// Result records how a node ended, Cause is the failed node a skipped node depends on
+type Result struct {
+	Status   Status
+	Worker   string
+	Err      error
+	Cause    int
+	Attempts int
+	Local    bool
+}
+
+type Report struct {
+	Results []Result
+}
+
+type result struct {
+	node   int
+	worker *Worker
+	err    error
+}
+
+// held is a streamed task waiting for the tasks producing its missing build files
+type held struct {
+	task    task.BuildInfo
+	missing []string
+}
+
+type dispatcher struct {
+	cfg *Config
+}
+
+// state is the bookkeeping of one run, owned by the scheduling loop
+type state struct {
+	cfg      *Config
+	graph    *task.Graph
+	report   *Report
+	workers  int
+	pool     map[string]*Worker
+	drained  map[*Worker]bool
+	free     []*Worker
+	local    []*Worker
+	ready    []int
+	fallback []int
+	pending  []int
+	held     []held
+	tried    []map[*Worker]bool
+	done     chan result
+	retry    chan int
+	running  int
+	waiting  int
+	failed   int
+	skipped  int
+	abort    bool
+	err      error
+}
+
+func New(_ context.Context, cfg *Config) Dispatcher {
+	return &dispatcher{
+		cfg: cfg,
+	}
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Retries: 2,
+		Backoff: time.Second,
+	}
+}
+
+// Nodes returns the nodes ended with status
+func (r *Report) Nodes(status Status) []int {
+	var buf []int
+
+	for i, item := range r.Results {
+		if item.Status == status {
+			buf = append(buf, i)
+		}
+	}
+
+	return buf
+}
+
+// Run releases every node once all of its dependencies have been built, in keep-going
+// mode a failed node only skips its dependents instead of stopping the build
+func (d *dispatcher) Run(ctx context.Context, workers []*Worker, graph *task.Graph) (*Report, error) {
+	s := d.newState(workers, graph)
+
+	if len(s.free) == 0 && len(s.local) == 0 && d.cfg.Changes == nil {
+		return s.report, errors.New("no worker slots available\n")
+	}
+
+	for i, item := range graph.Nodes {
+		s.pending[i] = len(item.Deps)
+		if s.pending[i] == 0 {
+			s.release(i)
+		}
+	}
+
+	return s.report, d.run(ctx, s, nil)
+}
+
+// RunStream builds tasks as they arrive on tasks until the channel is closed, a task
+// with build files neither on disk nor produced yet is held back until they are
+func (d *dispatcher) RunStream(ctx context.Context, workers []*Worker, tasks <-chan task.BuildInfo) (*task.Graph, *Report, error) {
+	s := d.newState(workers, &task.Graph{})
+
+	if len(s.free) == 0 && len(s.local) == 0 && d.cfg.Changes == nil {
+		return s.graph, s.report, errors.New("no worker slots available\n")
+	}
+
+	return s.graph, s.report, d.run(ctx, s, tasks)
+}
+
+func (d *dispatcher) newState(workers []*Worker, graph *task.Graph) *state {
+	s := &state{
+		cfg:     d.cfg,
+		graph:   graph,
+		workers: len(workers),
+		pool:    map[string]*Worker{},
+		drained: map[*Worker]bool{},
+		free:    slots(workers),
+		pending: make([]int, len(graph.Nodes)),
+		tried:   make([]map[*Worker]bool, len(graph.Nodes)),
+		done:    make(chan result),
+		retry:   make(chan int),
+		report: &Report{
+			Results: make([]Result, len(graph.Nodes)),
+		},
+	}
+
+	for _, item := range workers {
+		s.pool[item.Name] = item
+	}
+
+	if d.cfg.Fallback != nil {
+		s.local = slots([]*Worker{d.cfg.Fallback})
+	}
+
+	return s
+}
+
+// run is the scheduling loop, adding nodes from tasks until it is closed
+func (d *dispatcher) run(ctx context.Context, s *state, tasks <-chan task.BuildInfo) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	changes := d.cfg.Changes
+
+	for {
+		// a failed build stops reading tasks, so that the source stops decoding them
+		if tasks != nil && !s.dispatching() {
+			tasks = nil
+			s.held = nil
+		}
+
+		s.launch(ctx)
+
+		idle := s.running == 0 && s.waiting == 0
+
+		// queued nodes no slot can take wait for a worker to join
+		if idle && tasks == nil && (changes == nil || !s.queued()) {
+			break
+		}
+
+		var cancelled <-chan struct{}
+		if idle && changes != nil && s.queued() {
+			cancelled = ctx.Done()
+		}
+
+		var r result
+
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			s.change(c)
+			continue
+		case <-cancelled:
+			s.abort = true
+			if s.err == nil {
+				s.err = errors.Wrap(context.Cause(ctx), "no worker to build on\n")
+			}
+			continue
+		case t, ok := <-tasks:
+			if !ok {
+				tasks = nil
+				s.unheld()
+				continue
+			}
+			if err := s.stream(t); err != nil {
+				s.abort = true
+				tasks = nil
+				if s.err == nil {
+					s.err = errors.Wrap(err, "failed to add task\n")
+				}
+				cancel(s.err)
+			}
+			continue
+		case node := <-s.retry:
+			s.waiting--
+			if ctx.Err() == nil && s.dispatching() {
+				s.release(node)
+				continue
+			}
+			r = result{node: node, err: s.report.Results[node].Err}
+		case r = <-s.done:
+			if s.requeue(ctx, r) {
+				continue
+			}
+		}
+
+		if r.err != nil {
+			if err := s.fail(r); err != nil && !d.cfg.KeepGoing {
+				cancel(err)
+			}
+			continue
+		}
+
+		s.finish(r.node)
+	}
+
+	if s.err != nil {
+		if d.cfg.KeepGoing && !s.abort {
+			return errors.Wrapf(s.err, "%d tasks failed, %d skipped\n", s.failed, s.skipped)
+		}
+		return s.err
+	}
+
+	if len(s.report.Nodes(StatusDone)) != len(s.graph.Nodes) {
+		return errors.New("unresolved task dependencies\n")
+	}
+
+	return nil
+}
+
+// stream adds a task once the producers of its build files are known nodes, or its build
+// files are on disk and no task produces them, along with the held tasks it was the last
+// missing producer of
+func (s *state) stream(t task.BuildInfo) error {
+	if missing := s.missing(t.BuildFiles); len(missing) > 0 {
+		s.held = append(s.held, held{task: t, missing: missing})
+		return nil
+	}
+
+	if err := s.add(t); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(s.held); {
+		if len(s.missing(s.held[i].missing)) > 0 {
+			i++
+			continue
+		}
+		t = s.held[i].task
+		s.held = slices.Delete(s.held, i, i+1)
+		if err := s.add(t); err != nil {
+			return err
+		}
+		// the task may produce files of a held task checked before it
+		i = 0
+	}
+
+	return nil
+}
+
+// missing returns the files not produced by a node, whose producer is still to come
+// or which are not on disk. A file on disk is stale until the task producing it is built
+func (s *state) missing(files []string) []string {
+	var buf []string
+
+	for _, item := range files {
+		if s.graph.Produces(item) {
+			continue
+		}
+		if s.cfg.Produced != nil && s.cfg.Produced(item) || s.cfg.Exists != nil && !s.cfg.Exists(item) {
+			buf = append(buf, item)
+		}
+	}
+
+	return buf
+}
+
+// unheld fails the tasks still held once every task has arrived, their inputs
+// are neither on disk nor produced by any task
+func (s *state) unheld() {
+	if len(s.held) == 0 {
+		return
+	}
+
+	if s.err == nil {
+		item := s.held[0]
+		s.err = errors.Errorf("%d tasks have inputs neither on disk nor produced by any task, such as %s of %s\n",
+			len(s.held), item.missing[0], task.Label(item.task))
+	}
+
+	s.held = nil
+}
+
+// add links a streamed task into the graph and releases it if its dependencies are done,
+// in keep-going mode it is skipped right away when one of them failed
+func (s *state) add(t task.BuildInfo) error {
+	node, err := s.graph.Add(t)
+	if err != nil {
+		return err
+	}
+
+	s.pending = append(s.pending, 0)
+	s.tried = append(s.tried, nil)
+	s.report.Results = append(s.report.Results, Result{})
+
+	for _, dep := range s.graph.Nodes[node].Deps {
+		switch s.report.Results[dep].Status {
+		case StatusDone:
+		case StatusFailed, StatusSkipped:
+			if !s.cfg.KeepGoing {
+				s.pending[node]++
+				continue
+			}
+			cause := dep
+			if s.report.Results[dep].Status == StatusSkipped {
+				cause = s.report.Results[dep].Cause
+			}
+			s.report.Results[node].Status = StatusSkipped
+			s.report.Results[node].Cause = cause
+			s.skipped++
+			return nil
+		default:
+			s.pending[node]++
+		}
+	}
+
+	if s.pending[node] == 0 {
+		s.release(node)
+	}
+
+	return nil
+}
+
+// release queues a node whose dependencies are done, locally if there are no remote slots
+func (s *state) release(node int) {
+	if s.workers == 0 {
+		s.fallback = append(s.fallback, node)
+		return
+	}
+
+	s.ready = append(s.ready, node)
+}
+
+func (s *state) dispatching() bool {
+	return !s.abort && (s.err == nil || s.cfg.KeepGoing)
+}
+
+// queued reports whether nodes wait for a slot
+func (s *state) queued() bool {
+	return s.dispatching() && len(s.ready)+len(s.fallback) > 0
+}
+
+// change adds a worker to the pool, or drains one so that it takes no more tasks
+func (s *state) change(c Change) {
+	name := c.Worker.Name
+
+	if c.Remove {
+		worker, ok := s.pool[name]
+		if !ok {
+			return
+		}
+		delete(s.pool, name)
+		s.drained[worker] = true
+		s.workers--
+		s.free = slices.DeleteFunc(s.free, func(item *Worker) bool {
+			return item == worker
+		})
+		// with the last worker gone, nodes waiting for one are built locally
+		if s.workers == 0 && s.cfg.Fallback != nil {
+			s.fallback = append(s.fallback, s.ready...)
+			s.ready = nil
+		}
+		return
+	}
+
+	if _, ok := s.pool[name]; ok {
+		return
+	}
+
+	s.pool[name] = c.Worker
+	s.workers++
+	s.free = append(s.free, slots([]*Worker{c.Worker})...)
+
+	// without a local worker, released nodes were waiting for this one
+	if s.cfg.Fallback == nil {
+		s.ready = append(s.ready, s.fallback...)
+		s.fallback = nil
+	}
+}
+
+// launch starts ready nodes on free remote slots and fallback nodes on local slots
+func (s *state) launch(ctx context.Context) {
+	for s.dispatching() && len(s.ready) > 0 && len(s.free) > 0 {
+		index, slot := -1, -1
+		for i, item := range s.ready {
+			if slot = pick(s.free, s.tried[item], s.workers); slot >= 0 {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			break
+		}
+		node, worker := s.ready[index], s.free[slot]
+		s.ready = append(s.ready[:index], s.ready[index+1:]...)
+		s.free = append(s.free[:slot], s.free[slot+1:]...)
+		s.start(ctx, node, worker)
+	}
+
+	for s.dispatching() && len(s.fallback) > 0 && len(s.local) > 0 {
+		node, worker := s.fallback[0], s.local[0]
+		s.fallback, s.local = s.fallback[1:], s.local[1:]
+		s.report.Results[node].Local = true
+		s.start(ctx, node, worker)
+	}
+}
+
+func (s *state) start(ctx context.Context, node int, worker *Worker) {
+	s.running++
+	s.report.Results[node].Attempts++
+
+	// streamed nodes may grow the graph while the task is running
+	build := &s.graph.Nodes[node].Task
+
+	go func() {
+		s.done <- result{node: node, worker: worker, err: worker.Exec(ctx, build)}
+	}()
+}
+
+// requeue frees the slot of r, and retries transport failures on another worker
+// or falls back to the local worker once the attempt budget is spent
+func (s *state) requeue(ctx context.Context, r result) bool {
+	s.running--
+	s.report.Results[r.node].Worker = r.worker.Name
+
+	if r.worker == s.cfg.Fallback {
+		s.local = append(s.local, r.worker)
+		return false
+	}
+
+	if !s.drained[r.worker] {
+		s.free = append(s.free, r.worker)
+	}
+
+	if r.err == nil || s.cfg.Retryable == nil || ctx.Err() != nil || !s.cfg.Retryable(r.err) {
+		return false
+	}
+
+	s.report.Results[r.node].Err = r.err
+
+	if s.report.Results[r.node].Attempts <= s.cfg.Retries {
+		if s.tried[r.node] == nil {
+			s.tried[r.node] = map[*Worker]bool{}
+		}
+		s.tried[r.node][r.worker] = true
+		s.waiting++
+		s.schedule(r.node, s.report.Results[r.node].Attempts)
+		return true
+	}
+
+	if s.cfg.Fallback != nil {
+		s.fallback = append(s.fallback, r.node)
+		return true
+	}
+
+	return false
+}
+
+// schedule requeues node after an exponential backoff
+func (s *state) schedule(node, attempts int) {
+	delay := s.cfg.Backoff << (attempts - 1)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if s.cfg.Backoff <= 0 {
+		delay = 0
+	}
+
+	time.AfterFunc(delay, func() {
+		s.retry <- node
+	})
+}
+
+// fail records a failed node and returns the first build error
+func (s *state) fail(r result) error {
+	s.report.Results[r.node].Status = StatusFailed
+	s.report.Results[r.node].Err = r.err
+	s.failed++
+
+	if s.cfg.KeepGoing {
+		s.skipped += s.skip(r.node)
+	}
+
+	if s.err != nil {
+		return nil
+	}
+
+	s.err = errors.Wrap(r.err, "failed to build on "+s.report.Results[r.node].Worker+"\n")
+
+	return s.err
+}
+
+// finish releases the dependents of a node built successfully
+func (s *state) finish(node int) {
+	s.report.Results[node].Status = StatusDone
+	s.report.Results[node].Err = nil
+
+	for _, item := range s.graph.Nodes[node].Dependents {
+		s.pending[item]--
+		if s.pending[item] == 0 && s.report.Results[item].Status == StatusPending {
+			s.release(item)
+		}
+	}
+}
+
+// skip marks every pending node depending on the failed node as skipped
+func (s *state) skip(node int) int {
+	count := 0
+	queue := []int{node}
+
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, item := range s.graph.Nodes[i].Dependents {
+			if s.report.Results[item].Status != StatusPending {
+				continue
+			}
+			s.report.Results[item].Status = StatusSkipped
+			s.report.Results[item].Cause = node
+			count++
+			queue = append(queue, item)
+		}
+	}
+
+	return count
+}
+
+// pick returns a free slot on a worker not tried yet, any slot once all workers are tried
+func pick(free []*Worker, tried map[*Worker]bool, workers int) int {
+	for i, item := range free {
+		if !tried[item] {
+			return i
+		}
+	}
+
+	if len(tried) >= workers && len(free) > 0 {
+		return 0
+	}
+
+	return -1
+}
+
+// slots interleaves worker slots so that tasks spread across workers first
+func slots(workers []*Worker) []*Worker {
+	var buf []*Worker
+
+	for round := 0; ; round++ {
+		found := false
+		for _, item := range workers {
+			if round < item.Slots {
+				buf = append(buf, item)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	return buf
+}
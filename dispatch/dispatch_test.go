@@ -0,0 +1,452 @@
+package dispatch
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"distbuild/boong/proxy/task"
+)
+
+func initDispatchTest(count int) *task.Graph {
+	var buf []task.BuildInfo
+
+	for i := 0; i < count; i++ {
+		buf = append(buf, task.BuildInfo{BuildRule: "rule", BuildTargets: []string{string(rune('a' + i))}})
+	}
+
+	g, _ := task.NewGraph(buf)
+
+	return g
+}
+
+func TestSlots(t *testing.T) {
+	w1 := &Worker{Name: "w1", Slots: 2}
+	w2 := &Worker{Name: "w2", Slots: 1}
+
+	buf := slots([]*Worker{w1, w2})
+	assert.Equal(t, []*Worker{w1, w2, w1}, buf)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	d := New(ctx, DefaultConfig())
+
+	var mutex sync.Mutex
+	var inflight, peak int32
+	built := map[string]string{}
+
+	exec := func(name string) ExecFunc {
+		return func(_ context.Context, build *task.BuildInfo) error {
+			n := atomic.AddInt32(&inflight, 1)
+			defer atomic.AddInt32(&inflight, -1)
+			mutex.Lock()
+			if n > peak {
+				peak = n
+			}
+			built[build.BuildTargets[0]] = name
+			mutex.Unlock()
+			return nil
+		}
+	}
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 2, Exec: exec("w1")},
+		{Name: "w2", Slots: 1, Exec: exec("w2")},
+	}
+
+	_, err := d.Run(ctx, workers, initDispatchTest(10))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 10, len(built))
+	assert.LessOrEqual(t, peak, int32(3))
+}
+
+func TestRunError(t *testing.T) {
+	ctx := context.Background()
+	d := New(ctx, DefaultConfig())
+
+	var count int32
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			atomic.AddInt32(&count, 1)
+			return errors.New("failed")
+		}},
+	}
+
+	_, err := d.Run(ctx, workers, initDispatchTest(5))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, int32(1), count)
+
+	_, err = d.Run(ctx, nil, initDispatchTest(1))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRunOrder(t *testing.T) {
+	ctx := context.Background()
+	d := New(ctx, DefaultConfig())
+
+	g, err := task.NewGraph([]task.BuildInfo{
+		{BuildRule: "link", BuildFiles: []string{"a.o", "b.o"}, BuildTargets: []string{"main"}},
+		{BuildRule: "cc a", BuildFiles: []string{"a.c"}, BuildTargets: []string{"a.o"}},
+		{BuildRule: "cc b", BuildFiles: []string{"b.c"}, BuildTargets: []string{"b.o"}},
+	})
+	assert.Equal(t, nil, err)
+
+	var mutex sync.Mutex
+	var order []string
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 4, Exec: func(_ context.Context, build *task.BuildInfo) error {
+			mutex.Lock()
+			order = append(order, build.BuildTargets[0])
+			mutex.Unlock()
+			return nil
+		}},
+	}
+
+	_, err = d.Run(ctx, workers, g)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(order))
+	assert.Equal(t, "main", order[2])
+}
+
+func TestRunKeepGoing(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.KeepGoing = true
+
+	d := New(ctx, cfg)
+
+	g, err := task.NewGraph([]task.BuildInfo{
+		{BuildRule: "link", BuildFiles: []string{"a.o", "b.o"}, BuildTargets: []string{"main"}},
+		{BuildRule: "cc a", BuildFiles: []string{"a.c"}, BuildTargets: []string{"a.o"}},
+		{BuildRule: "cc b", BuildFiles: []string{"b.c"}, BuildTargets: []string{"b.o"}},
+		{BuildRule: "cc c", BuildFiles: []string{"c.c"}, BuildTargets: []string{"c.o"}},
+	})
+	assert.Equal(t, nil, err)
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, build *task.BuildInfo) error {
+			if build.BuildTargets[0] == "a.o" {
+				return errors.New("failed")
+			}
+			return nil
+		}},
+	}
+
+	report, err := d.Run(ctx, workers, g)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, []int{2, 3}, report.Nodes(StatusDone))
+	assert.Equal(t, []int{1}, report.Nodes(StatusFailed))
+	assert.Equal(t, []int{0}, report.Nodes(StatusSkipped))
+	assert.Equal(t, 1, report.Results[0].Cause)
+	assert.Equal(t, "w1", report.Results[1].Worker)
+}
+
+func TestRunRetry(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.Backoff = time.Millisecond
+	cfg.Retryable = func(err error) bool {
+		return err.Error() == "unavailable"
+	}
+
+	d := New(ctx, cfg)
+
+	var count int32
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			atomic.AddInt32(&count, 1)
+			return errors.New("unavailable")
+		}},
+		{Name: "w2", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			return nil
+		}},
+	}
+
+	report, err := d.Run(ctx, workers, initDispatchTest(1))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "w2", report.Results[0].Worker)
+	assert.Equal(t, 2, report.Results[0].Attempts)
+
+	workers[1].Exec = workers[0].Exec
+
+	report, err = d.Run(ctx, workers, initDispatchTest(1))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, cfg.Retries+1, report.Results[0].Attempts)
+
+	workers[0].Exec = func(_ context.Context, _ *task.BuildInfo) error {
+		return errors.New("compile error")
+	}
+
+	report, err = d.Run(ctx, workers[:1], initDispatchTest(1))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 1, report.Results[0].Attempts)
+}
+
+func TestRunFallback(t *testing.T) {
+	ctx := context.Background()
+
+	local := &Worker{Name: "local", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+		return nil
+	}}
+
+	cfg := DefaultConfig()
+	cfg.Retries = 1
+	cfg.Backoff = time.Millisecond
+	cfg.Fallback = local
+	cfg.Retryable = func(err error) bool {
+		return err.Error() == "unavailable"
+	}
+
+	d := New(ctx, cfg)
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			return errors.New("unavailable")
+		}},
+	}
+
+	report, err := d.Run(ctx, workers, initDispatchTest(2))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, report.Results[0].Local)
+	assert.Equal(t, "local", report.Results[1].Worker)
+	assert.Equal(t, 3, report.Results[1].Attempts)
+
+	report, err = d.Run(ctx, nil, initDispatchTest(2))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{0, 1}, report.Nodes(StatusDone))
+	assert.Equal(t, 1, report.Results[0].Attempts)
+}
+
+func TestRunStream(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.KeepGoing = true
+	d := New(ctx, cfg)
+
+	var mutex sync.Mutex
+	var order []string
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 2, Exec: func(_ context.Context, build *task.BuildInfo) error {
+			mutex.Lock()
+			order = append(order, build.BuildTargets[0])
+			mutex.Unlock()
+			if build.BuildTargets[0] == "bad.o" {
+				return errors.New("failed")
+			}
+			return nil
+		}},
+	}
+
+	tasks := make(chan task.BuildInfo)
+
+	go func() {
+		defer close(tasks)
+		tasks <- task.BuildInfo{BuildRule: "cc a.c", BuildFiles: []string{"a.c"}, BuildTargets: []string{"a.o"}}
+		tasks <- task.BuildInfo{BuildRule: "cc bad.c", BuildFiles: []string{"bad.c"}, BuildTargets: []string{"bad.o"}}
+		tasks <- task.BuildInfo{BuildRule: "ld a.o", BuildFiles: []string{"a.o"}, BuildTargets: []string{"a"}}
+		time.Sleep(10 * time.Millisecond)
+		tasks <- task.BuildInfo{BuildRule: "ld bad.o", BuildFiles: []string{"bad.o"}, BuildTargets: []string{"bad"}}
+	}()
+
+	graph, report, err := d.RunStream(ctx, workers, tasks)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 4, len(graph.Nodes))
+	assert.Equal(t, []int{0, 2}, report.Nodes(StatusDone))
+	assert.Equal(t, []int{1}, report.Nodes(StatusFailed))
+	assert.Equal(t, []int{3}, report.Nodes(StatusSkipped))
+	assert.Equal(t, 1, report.Results[3].Cause)
+
+	mutex.Lock()
+	assert.Equal(t, 3, len(order))
+	assert.Equal(t, true, indexOf(order, "a.o") < indexOf(order, "a"))
+	mutex.Unlock()
+}
+
+func TestRunStreamOrder(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.Exists = func(name string) bool {
+		return name == "a.c"
+	}
+
+	d := New(ctx, cfg)
+
+	var mutex sync.Mutex
+	var built []string
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, build *task.BuildInfo) error {
+			mutex.Lock()
+			built = append(built, build.BuildTargets[0])
+			mutex.Unlock()
+			return nil
+		}},
+	}
+
+	stream := func(buf ...task.BuildInfo) <-chan task.BuildInfo {
+		tasks := make(chan task.BuildInfo, len(buf))
+		for _, item := range buf {
+			tasks <- item
+		}
+		close(tasks)
+		return tasks
+	}
+
+	link := task.BuildInfo{BuildRule: "ld a.o", BuildFiles: []string{"a.o"}, BuildTargets: []string{"a"}}
+	compile := task.BuildInfo{BuildRule: "cc a.c", BuildFiles: []string{"a.c"}, BuildTargets: []string{"a.o"}}
+
+	// the link waits for the compile producing its input
+	graph, _, err := d.RunStream(ctx, workers, stream(link, compile))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"a.o", "a"}, built)
+	assert.Equal(t, []int{0}, graph.Nodes[1].Deps)
+
+	// a stale input on disk still waits for the task of the stream producing it
+	cfg.Produced = func(name string) bool {
+		return name == "a.o"
+	}
+	cfg.Exists = func(string) bool {
+		return true
+	}
+
+	built = nil
+
+	_, _, err = d.RunStream(ctx, workers, stream(link, compile))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"a.o", "a"}, built)
+
+	// an input on disk no task produces does not wait
+	built = nil
+
+	_, _, err = d.RunStream(ctx, workers, stream(compile))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"a.o"}, built)
+
+	// an input neither on disk nor produced by any task is never built
+	cfg.Produced = nil
+	cfg.Exists = func(string) bool {
+		return false
+	}
+
+	built = nil
+
+	_, _, err = d.RunStream(ctx, workers, stream(link))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(built))
+}
+
+func TestRunStreamError(t *testing.T) {
+	ctx := context.Background()
+	d := New(ctx, DefaultConfig())
+
+	failed := make(chan struct{})
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			close(failed)
+			return errors.New("build failed")
+		}},
+	}
+
+	tasks := make(chan task.BuildInfo)
+	stop := make(chan struct{})
+
+	var sent atomic.Int32
+
+	go func() {
+		defer close(tasks)
+		for i := 0; i < 100; i++ {
+			select {
+			case tasks <- task.BuildInfo{BuildRule: "rule", BuildTargets: []string{strconv.Itoa(i)}}:
+				sent.Add(1)
+			case <-stop:
+				return
+			}
+			if i == 0 {
+				<-failed
+			}
+		}
+	}()
+
+	// the first failure stops reading the remaining tasks
+	_, _, err := d.RunStream(ctx, workers, tasks)
+	assert.NotEqual(t, nil, err)
+	assert.Less(t, sent.Load(), int32(100))
+
+	close(stop)
+}
+
+func TestRunChanges(t *testing.T) {
+	ctx := context.Background()
+
+	changes := make(chan Change)
+
+	cfg := DefaultConfig()
+	cfg.Changes = changes
+	d := New(ctx, cfg)
+
+	exec := func(_ context.Context, _ *task.BuildInfo) error {
+		return nil
+	}
+
+	w2 := &Worker{Name: "w2", Slots: 2, Exec: exec}
+
+	var once sync.Once
+
+	workers := []*Worker{
+		{Name: "w1", Slots: 1, Exec: func(_ context.Context, _ *task.BuildInfo) error {
+			// w1 leaves while building its first task, w2 takes the rest
+			once.Do(func() {
+				changes <- Change{Worker: &Worker{Name: "w1"}, Remove: true}
+				changes <- Change{Worker: w2}
+			})
+			return nil
+		}},
+	}
+
+	report, err := d.Run(ctx, workers, initDispatchTest(4))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "w1", report.Results[0].Worker)
+	assert.Equal(t, "w2", report.Results[1].Worker)
+	assert.Equal(t, "w2", report.Results[2].Worker)
+	assert.Equal(t, "w2", report.Results[3].Worker)
+
+	// nodes wait for a worker to join when there is none
+	go func() {
+		changes <- Change{Worker: &Worker{Name: "w3", Slots: 1, Exec: exec}}
+	}()
+
+	report, err = d.Run(ctx, nil, initDispatchTest(2))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "w3", report.Results[1].Worker)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = d.Run(ctx, nil, initDispatchTest(1))
+	assert.NotEqual(t, nil, err)
+}
+
+func indexOf(buf []string, name string) int {
+	for i, item := range buf {
+		if item == name {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,46 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+type Result struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// Run runs rule through the system shell in dir
+func Run(ctx context.Context, dir, rule string) (*Result, error) {
+	var cmd *exec.Cmd
+	var stdout, stderr bytes.Buffer
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", rule)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", rule)
+	}
+
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, errors.Wrap(err, "failed to run command\n")
+		}
+	}
+
+	return &Result{
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+	}, nil
+}
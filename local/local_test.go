@@ -0,0 +1,33 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell syntax differs on windows")
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ret, err := Run(ctx, dir, "echo hello > out.txt")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, ret.ExitCode)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello\n", string(buf))
+
+	ret, err = Run(ctx, dir, "echo failed >&2; exit 3")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, ret.ExitCode)
+	assert.Equal(t, "failed\n", string(ret.Stderr))
+}
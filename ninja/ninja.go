@@ -2,15 +2,15 @@ package ninja
 
 import (
 	"context"
-	"encoding/json"
+	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/pkg/errors"
-)
 
-const (
-	executableName = "ninja"
+	"distbuild/boong/proxy/task"
 )
 
 type Ninja interface {
@@ -19,13 +19,9 @@ type Ninja interface {
 	Load(context.Context) ([]Build, error)
 }
 
-type Config struct{}
-
-type File struct {
-	Directory string `json:"directory"`
-	Command   string `json:"command"`
-	File      string `json:"file"`
-	Output    string `json:"output"`
+// Config holds the directory ninja runs in, which build paths are relative to
+type Config struct {
+	Dir string
 }
 
 type Build struct {
@@ -34,6 +30,12 @@ type Build struct {
 	BuildRule    string
 	BuildPath    string
 	BuildTargets []string
+	Rule         string
+	OrderOnly    []string
+	Depfile      string
+	Pool         string
+	Phony        bool
+	Default      bool
 }
 
 type ninja struct {
@@ -41,6 +43,13 @@ type ninja struct {
 	file string
 }
 
+type source struct {
+	cfg  *Config
+	file string
+	root string
+	opts *task.Options
+}
+
 func New(_ context.Context, cfg *Config) Ninja {
 	return &ninja{
 		cfg: cfg,
@@ -48,7 +57,11 @@ func New(_ context.Context, cfg *Config) Ninja {
 }
 
 func DefaultConfig() *Config {
-	return &Config{}
+	dir, _ := os.Getwd()
+
+	return &Config{
+		Dir: dir,
+	}
 }
 
 func (n *ninja) Init(ctx context.Context, name string) error {
@@ -66,19 +79,12 @@ func (n *ninja) Deinit(_ context.Context) error {
 }
 
 func (n *ninja) Load(ctx context.Context) ([]Build, error) {
-	var buf []Build
-
-	out, err := n.run(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to run ninja\n")
-	}
-
-	buf, err = n.parse(ctx, out)
+	m, err := Parse(n.file, n.cfg.Dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse ninja\n")
 	}
 
-	return buf, nil
+	return n.builds(ctx, m), nil
 }
 
 func (n *ninja) check(_ context.Context) error {
@@ -89,40 +95,192 @@ func (n *ninja) check(_ context.Context) error {
 	return nil
 }
 
-func (n *ninja) run(ctx context.Context) ([]byte, error) {
-	path, err := exec.LookPath(executableName)
+// builds flattens the edges of m, explicit and implicit files alike
+func (n *ninja) builds(_ context.Context, m *Manifest) []Build {
+	var ret []Build
+
+	for _, item := range m.Edges {
+		targets := slices.Concat(item.Outputs, item.ImplicitOutputs)
+		b := Build{
+			BuildLang:    "",
+			BuildFiles:   slices.Concat(item.Inputs, item.Implicit),
+			BuildRule:    item.Command,
+			BuildPath:    n.cfg.Dir,
+			BuildTargets: targets,
+			Rule:         item.Rule,
+			OrderOnly:    item.OrderOnly,
+			Depfile:      item.Depfile,
+			Pool:         item.Pool,
+			Phony:        item.Rule == phonyRule,
+			Default: slices.ContainsFunc(targets, func(target string) bool {
+				return slices.Contains(m.Defaults, target)
+			}),
+		}
+		ret = append(ret, b)
+	}
+
+	return ret
+}
+
+// NewSource reads the tasks of the ninja file name relative to the workspace root
+func NewSource(cfg *Config, name, root string, opts *task.Options) task.Source {
+	return &source{
+		cfg:  cfg,
+		file: name,
+		root: root,
+		opts: opts,
+	}
+}
+
+func (s *source) Load(ctx context.Context) ([]task.BuildInfo, error) {
+	n := New(ctx, s.cfg)
+
+	if err := n.Init(ctx, s.file); err != nil {
+		return nil, errors.Wrap(err, "failed to init ninja\n")
+	}
+
+	defer func(n Ninja, ctx context.Context) {
+		_ = n.Deinit(ctx)
+	}(n, ctx)
+
+	builds, err := n.Load(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to find executable name\n")
+		return nil, errors.Wrap(err, "failed to load ninja\n")
 	}
 
-	cmd := exec.CommandContext(ctx, path, "-f", n.file, "-t", "compdb")
+	tasks, err := Tasks(builds, s.root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert builds\n")
+	}
 
-	out, err := cmd.CombinedOutput()
+	ignore, err := task.LoadIgnore(s.root, s.opts.Exclude)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to run command\n")
+		return nil, errors.Wrap(err, "failed to load exclusion rules\n")
+	}
+
+	db, err := task.OpenDepDB(s.root)
+	if err != nil {
+		log.Printf("failed to open dependency database: %v\n", err)
+	}
+
+	// headers are only known from depfiles of previous builds, the inputs of the
+	// build statement are kept even if an exclusion rule matches them
+	for i, item := range tasks {
+		if len(item.BuildTargets) == 0 {
+			continue
+		}
+		if inputs, ok := db.Lookup(s.root, item.BuildTargets[0], item.BuildRule); ok {
+			ignore.Merge(s.root, &tasks[i], inputs)
+		}
 	}
 
-	return out, nil
+	return tasks, nil
 }
 
-func (n *ninja) parse(_ context.Context, data []byte) ([]Build, error) {
-	var buf []File
-	var ret []Build
+// Tasks converts builds into tasks relative to the workspace root, phony
+// targets are replaced by the files they stand for and inputs outside the
+// workspace are left to the worker
+func Tasks(builds []Build, root string) ([]task.BuildInfo, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get workspace path\n")
+	}
+
+	phony := map[string][]string{}
 
-	if err := json.Unmarshal(data, &buf); err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal json\n")
+	for _, item := range builds {
+		if item.Phony {
+			for _, target := range item.BuildTargets {
+				phony[filepath.Join(item.BuildPath, target)] = slices.Concat(item.BuildFiles, item.OrderOnly)
+			}
+		}
 	}
 
-	for _, item := range buf {
-		b := Build{
-			BuildLang:    "",
-			BuildFiles:   []string{item.File},
-			BuildRule:    item.Command,
-			BuildPath:    item.Directory,
-			BuildTargets: []string{item.Output},
+	var ret []task.BuildInfo
+
+	for _, item := range builds {
+		if item.Phony || item.BuildRule == "" {
+			continue
+		}
+
+		dir, err := relPath(root, item.BuildPath, ".")
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid build path\n")
+		}
+
+		b := task.BuildInfo{
+			BuildRule: item.BuildRule,
+			BuildPath: dir,
+		}
+
+		if b.BuildPath == "." {
+			b.BuildPath = ""
 		}
+
+		seen := map[string]bool{}
+
+		var expand func(names []string)
+		expand = func(names []string) {
+			for _, name := range names {
+				p := filepath.Join(item.BuildPath, name)
+				if filepath.IsAbs(name) {
+					p = name
+				}
+				if seen[p] {
+					continue
+				}
+				seen[p] = true
+				if inputs, ok := phony[p]; ok {
+					expand(inputs)
+					continue
+				}
+				if rel, err := relPath(root, item.BuildPath, name); err == nil {
+					b.BuildFiles = append(b.BuildFiles, rel)
+				}
+			}
+		}
+
+		expand(slices.Concat(item.BuildFiles, item.OrderOnly))
+
+		for _, target := range item.BuildTargets {
+			rel, err := relPath(root, item.BuildPath, target)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid build target\n")
+			}
+			b.BuildTargets = append(b.BuildTargets, rel)
+		}
+
+		if item.Depfile != "" {
+			if b.Depfile, err = relPath(root, item.BuildPath, item.Depfile); err != nil {
+				return nil, errors.Wrap(err, "invalid depfile\n")
+			}
+			if !slices.Contains(b.BuildTargets, b.Depfile) {
+				b.BuildTargets = append(b.BuildTargets, b.Depfile)
+			}
+		}
+
 		ret = append(ret, b)
 	}
 
 	return ret, nil
 }
+
+// relPath resolves name against dir and makes it relative to root
+func relPath(root, dir, name string) (string, error) {
+	p := name
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, name)
+	}
+
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(name + " is outside of the workspace\n")
+	}
+
+	return rel, nil
+}
@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"distbuild/boong/proxy/task"
 )
 
 const (
@@ -13,6 +15,7 @@ const (
 
 func initNinjaTest() ninja {
 	return ninja{
+		cfg:  DefaultConfig(),
 		file: testNinjaName,
 	}
 }
@@ -25,20 +28,70 @@ func TestCheck(t *testing.T) {
 	assert.Equal(t, nil, err)
 }
 
-func TestRun(t *testing.T) {
+func TestLoad(t *testing.T) {
 	ctx := context.Background()
 	n := initNinjaTest()
 
-	_, err := n.run(ctx)
+	buf, err := n.Load(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(buf))
+
+	assert.Equal(t, "compile", buf[0].Rule)
+	assert.Equal(t, []string{"test/cpp/main.cpp"}, buf[0].BuildFiles)
+	assert.Equal(t, []string{"test/result/main.o"}, buf[0].BuildTargets)
+	assert.Equal(t, "g++ -Wall -std=c++11 -c test/cpp/main.cpp -o test/result/main.o", buf[0].BuildRule)
+	assert.Equal(t, n.cfg.Dir, buf[0].BuildPath)
+	assert.Equal(t, false, buf[0].Default)
+
+	assert.Equal(t, "link", buf[1].Rule)
+	assert.Equal(t, []string{"test/result/main.o"}, buf[1].BuildFiles)
+	assert.Equal(t, "g++ test/result/main.o -o test/result/main", buf[1].BuildRule)
+	assert.Equal(t, true, buf[1].Default)
+}
+
+func TestSource(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.Dir = ".."
+
+	tasks, err := NewSource(cfg, testNinjaName, "..", &task.Options{Exclude: []string{"test/"}}).Load(ctx)
 	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(tasks))
+	// exclusion rules never drop the inputs of a build statement
+	assert.Equal(t, []string{"test/cpp/main.cpp"}, tasks[0].BuildFiles)
+	assert.Equal(t, []string{"test/result/main.o"}, tasks[1].BuildFiles)
 }
 
-func TestParse(t *testing.T) {
+func TestTasks(t *testing.T) {
 	ctx := context.Background()
 	n := initNinjaTest()
+	n.cfg.Dir = ".."
+
+	buf, err := n.Load(ctx)
+	assert.Equal(t, nil, err)
+
+	tasks, err := Tasks(buf, "..")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, "", tasks[0].BuildPath)
+	assert.Equal(t, []string{"test/cpp/main.cpp"}, tasks[0].BuildFiles)
+	assert.Equal(t, []string{"test/result/main"}, tasks[1].BuildTargets)
 
-	buf, _ := n.run(ctx)
+	builds := []Build{
+		{BuildFiles: []string{"gen.h"}, BuildPath: "/src/out", BuildTargets: []string{"headers"}, Phony: true},
+		{BuildFiles: []string{"../a.c", "/usr/include/stdio.h"}, BuildRule: "cc -c ../a.c -o a.o", BuildPath: "/src/out", BuildTargets: []string{"a.o"}, OrderOnly: []string{"headers"}},
+	}
 
-	_, err := n.parse(ctx, buf)
+	tasks, err = Tasks(builds, "/src")
 	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, "out", tasks[0].BuildPath)
+	assert.Equal(t, []string{"a.c", "out/gen.h"}, tasks[0].BuildFiles)
+	assert.Equal(t, []string{"out/a.o"}, tasks[0].BuildTargets)
+
+	builds[1].BuildTargets = []string{"../../a.o"}
+
+	_, err = Tasks(builds, "/src")
+	assert.NotEqual(t, nil, err)
 }
@@ -0,0 +1,699 @@
+package ninja
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	phonyRule = "phony"
+	maxDepth  = 64
+)
+
+// Edge is one build statement with its variables evaluated
+type Edge struct {
+	Rule            string
+	Outputs         []string
+	ImplicitOutputs []string
+	Inputs          []string
+	Implicit        []string
+	OrderOnly       []string
+	Validations     []string
+	Command         string
+	Description     string
+	Depfile         string
+	Pool            string
+}
+
+// Manifest is the build graph described by a ninja file and its includes
+type Manifest struct {
+	Edges    []*Edge
+	Defaults []string
+	Pools    map[string]int
+}
+
+type token struct {
+	value string
+	isVar bool
+}
+
+// evalString is a value whose variables are expanded on evaluation
+type evalString []token
+
+type rule struct {
+	name string
+	vars map[string]evalString
+}
+
+type env struct {
+	vars   map[string]string
+	rules  map[string]*rule
+	parent *env
+}
+
+type edgeEnv struct {
+	edge  *Edge
+	rule  *rule
+	vars  map[string]string
+	scope *env
+	depth int
+}
+
+type scanner struct {
+	line string
+	pos  int
+}
+
+type parser struct {
+	dir      string
+	manifest *Manifest
+	file     string
+	lines    []string
+	numbers  []int
+	index    int
+}
+
+func newEnv(parent *env) *env {
+	return &env{
+		vars:   map[string]string{},
+		rules:  map[string]*rule{},
+		parent: parent,
+	}
+}
+
+// Parse reads the manifest in name, resolving include and subninja paths against dir
+func Parse(name, dir string) (*Manifest, error) {
+	m := &Manifest{
+		Pools: map[string]int{"console": 1},
+	}
+
+	scope := newEnv(nil)
+	scope.rules[phonyRule] = &rule{name: phonyRule, vars: map[string]evalString{}}
+
+	if err := parseFile(m, name, dir, scope, 0); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func parseFile(m *Manifest, name, dir string, scope *env, depth int) error {
+	if depth > maxDepth {
+		return errors.New("include depth exceeded in " + name + "\n")
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to read "+name+"\n")
+	}
+
+	p := &parser{
+		dir:      dir,
+		manifest: m,
+		file:     name,
+	}
+
+	p.lines, p.numbers = joinLines(data)
+
+	return p.parse(scope, depth)
+}
+
+// joinLines splits data into logical lines, joining lines continued with a trailing $
+func joinLines(data []byte) ([]string, []int) {
+	var lines []string
+	var numbers []int
+
+	physical := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(physical); i++ {
+		line := physical[i]
+		number := i + 1
+		for continued(line) && i+1 < len(physical) {
+			i++
+			line = line[:len(line)-1] + strings.TrimLeft(physical[i], " ")
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, number)
+	}
+
+	return lines, numbers
+}
+
+// continued reports whether line ends with an unescaped $
+func continued(line string) bool {
+	count := 0
+
+	for i := len(line) - 1; i >= 0 && line[i] == '$'; i-- {
+		count++
+	}
+
+	return count%2 == 1
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return errors.Errorf("%s:%d: %s\n", p.file, p.numbers[p.index], fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parse(scope *env, depth int) error {
+	for p.index = 0; p.index < len(p.lines); p.index++ {
+		line := p.lines[p.index]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed != line {
+			return p.errorf("unexpected indent")
+		}
+
+		s := &scanner{line: line}
+		keyword := s.ident()
+
+		var err error
+
+		switch keyword {
+		case "rule":
+			err = p.parseRule(s, scope)
+		case "build":
+			err = p.parseEdge(s, scope)
+		case "pool":
+			err = p.parsePool(s, scope)
+		case "default":
+			err = p.parseDefault(s, scope)
+		case "include", "subninja":
+			err = p.parseInclude(s, scope, keyword == "subninja", depth)
+		default:
+			if keyword == "" {
+				return p.errorf("expected identifier")
+			}
+			var value evalString
+			value, err = p.parseAssign(s)
+			if err == nil {
+				scope.vars[keyword] = value.eval(scope.lookup)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindings parses the indented key = value lines following a declaration
+func (p *parser) bindings() (map[string]evalString, []string, error) {
+	vars := map[string]evalString{}
+
+	var keys []string
+
+	for p.index+1 < len(p.lines) {
+		line := p.lines[p.index+1]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == line || trimmed == "" {
+			break
+		}
+		p.index++
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		s := &scanner{line: trimmed}
+		key := s.ident()
+		if key == "" {
+			return nil, nil, p.errorf("expected variable name")
+		}
+		value, err := p.parseAssign(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := vars[key]; !ok {
+			keys = append(keys, key)
+		}
+		vars[key] = value
+	}
+
+	return vars, keys, nil
+}
+
+func (p *parser) parseAssign(s *scanner) (evalString, error) {
+	s.spaces()
+
+	if !s.consume('=') {
+		return nil, p.errorf("expected '='")
+	}
+
+	s.spaces()
+
+	value, err := s.value(false)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+
+	return value, nil
+}
+
+func (p *parser) parseRule(s *scanner, scope *env) error {
+	s.spaces()
+
+	name := s.ident()
+	if name == "" {
+		return p.errorf("expected rule name")
+	}
+
+	if !s.end() {
+		return p.errorf("unexpected text after rule name")
+	}
+
+	if _, ok := scope.rules[name]; ok {
+		return p.errorf("duplicate rule '%s'", name)
+	}
+
+	vars, _, err := p.bindings()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := vars["command"]; !ok {
+		return p.errorf("expected 'command =' line")
+	}
+
+	scope.rules[name] = &rule{name: name, vars: vars}
+
+	return nil
+}
+
+func (p *parser) parsePool(s *scanner, scope *env) error {
+	s.spaces()
+
+	name := s.ident()
+	if name == "" {
+		return p.errorf("expected pool name")
+	}
+
+	if _, ok := p.manifest.Pools[name]; ok {
+		return p.errorf("duplicate pool '%s'", name)
+	}
+
+	vars, _, err := p.bindings()
+	if err != nil {
+		return err
+	}
+
+	value, ok := vars["depth"]
+	if !ok {
+		return p.errorf("expected 'depth =' line")
+	}
+
+	depth, err := strconv.Atoi(value.eval(scope.lookup))
+	if err != nil || depth < 0 {
+		return p.errorf("invalid pool depth")
+	}
+
+	p.manifest.Pools[name] = depth
+
+	return nil
+}
+
+func (p *parser) parseDefault(s *scanner, scope *env) error {
+	paths, err := p.paths(s)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 || !s.end() {
+		return p.errorf("expected target name")
+	}
+
+	for _, item := range paths {
+		p.manifest.Defaults = append(p.manifest.Defaults, filepath.Clean(item.eval(scope.lookup)))
+	}
+
+	return nil
+}
+
+func (p *parser) parseInclude(s *scanner, scope *env, sub bool, depth int) error {
+	s.spaces()
+
+	path, err := s.value(true)
+	if err != nil || len(path) == 0 {
+		return p.errorf("expected path")
+	}
+
+	name := path.eval(scope.lookup)
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(p.dir, name)
+	}
+
+	if sub {
+		scope = newEnv(scope)
+	}
+
+	return parseFile(p.manifest, name, p.dir, scope, depth+1)
+}
+
+func (p *parser) parseEdge(s *scanner, scope *env) error {
+	outputs, err := p.paths(s)
+	if err != nil {
+		return err
+	}
+
+	var implicitOutputs []evalString
+
+	if s.consumeOp("|") {
+		if implicitOutputs, err = p.paths(s); err != nil {
+			return err
+		}
+	}
+
+	if len(outputs)+len(implicitOutputs) == 0 {
+		return p.errorf("expected path")
+	}
+
+	s.spaces()
+
+	if !s.consume(':') {
+		return p.errorf("expected ':'")
+	}
+
+	s.spaces()
+
+	name := s.ident()
+
+	r := scope.findRule(name)
+	if r == nil {
+		return p.errorf("unknown build rule '%s'", name)
+	}
+
+	inputs, err := p.paths(s)
+	if err != nil {
+		return err
+	}
+
+	var implicit, orderOnly, validations []evalString
+
+	if s.consumeOp("|") {
+		if implicit, err = p.paths(s); err != nil {
+			return err
+		}
+	}
+
+	if s.consumeOp("||") {
+		if orderOnly, err = p.paths(s); err != nil {
+			return err
+		}
+	}
+
+	if s.consumeOp("|@") {
+		if validations, err = p.paths(s); err != nil {
+			return err
+		}
+	}
+
+	if !s.end() {
+		return p.errorf("unexpected text in build statement")
+	}
+
+	vars, keys, err := p.bindings()
+	if err != nil {
+		return err
+	}
+
+	e := &edgeEnv{
+		edge:  &Edge{Rule: name},
+		rule:  r,
+		vars:  map[string]string{},
+		scope: scope,
+	}
+
+	// edge bindings are evaluated in the enclosing scope
+	for _, key := range keys {
+		e.vars[key] = vars[key].eval(scope.lookup)
+	}
+
+	e.edge.Outputs = evalPaths(outputs, e.lookupPath)
+	e.edge.ImplicitOutputs = evalPaths(implicitOutputs, e.lookupPath)
+	e.edge.Inputs = evalPaths(inputs, e.lookupPath)
+	e.edge.Implicit = evalPaths(implicit, e.lookupPath)
+	e.edge.OrderOnly = evalPaths(orderOnly, e.lookupPath)
+	e.edge.Validations = evalPaths(validations, e.lookupPath)
+
+	e.edge.Command = e.lookup("command")
+	e.edge.Description = e.lookup("description")
+	e.edge.Depfile = e.lookup("depfile")
+	e.edge.Pool = e.lookup("pool")
+
+	if e.edge.Pool != "" {
+		if _, ok := p.manifest.Pools[e.edge.Pool]; !ok {
+			return p.errorf("unknown pool name '%s'", e.edge.Pool)
+		}
+	}
+
+	p.manifest.Edges = append(p.manifest.Edges, e.edge)
+
+	return nil
+}
+
+// paths reads space separated paths up to a ':', '|' or the end of the line
+func (p *parser) paths(s *scanner) ([]evalString, error) {
+	var buf []evalString
+
+	for {
+		s.spaces()
+		path, err := s.value(true)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if len(path) == 0 {
+			return buf, nil
+		}
+		buf = append(buf, path)
+	}
+}
+
+func evalPaths(paths []evalString, lookup func(string) string) []string {
+	var buf []string
+
+	for _, item := range paths {
+		buf = append(buf, filepath.Clean(item.eval(lookup)))
+	}
+
+	return buf
+}
+
+func (e *env) lookup(name string) string {
+	for scope := e; scope != nil; scope = scope.parent {
+		if value, ok := scope.vars[name]; ok {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func (e *env) findRule(name string) *rule {
+	for scope := e; scope != nil; scope = scope.parent {
+		if r, ok := scope.rules[name]; ok {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// lookup resolves a variable of the edge: $in and $out, then edge bindings,
+// then rule bindings evaluated against the edge, then the enclosing scope
+func (e *edgeEnv) lookup(name string) string {
+	switch name {
+	case "in":
+		return joinShell(e.edge.Inputs, " ")
+	case "in_newline":
+		return joinShell(e.edge.Inputs, "\n")
+	case "out":
+		return joinShell(e.edge.Outputs, " ")
+	}
+
+	if value, ok := e.vars[name]; ok {
+		return value
+	}
+
+	if value, ok := e.rule.vars[name]; ok {
+		if e.depth > maxDepth {
+			return ""
+		}
+		e.depth++
+		defer func() {
+			e.depth--
+		}()
+		return value.eval(e.lookup)
+	}
+
+	return e.scope.lookup(name)
+}
+
+// lookupPath resolves variables in paths, where rule bindings do not apply
+func (e *edgeEnv) lookupPath(name string) string {
+	if value, ok := e.vars[name]; ok {
+		return value
+	}
+
+	return e.scope.lookup(name)
+}
+
+func (v evalString) eval(lookup func(string) string) string {
+	var buf strings.Builder
+
+	for _, item := range v {
+		if item.isVar {
+			buf.WriteString(lookup(item.value))
+		} else {
+			buf.WriteString(item.value)
+		}
+	}
+
+	return buf.String()
+}
+
+func joinShell(paths []string, sep string) string {
+	var buf []string
+
+	for _, item := range paths {
+		buf = append(buf, shellEscape(item))
+	}
+
+	return strings.Join(buf, sep)
+}
+
+func shellEscape(s string) string {
+	safe := true
+
+	for _, c := range s {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+-./:@,%=", c) {
+			safe = false
+			break
+		}
+	}
+
+	if safe || s == "" {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isVarChar(c byte, braced bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || (braced && c == '.')
+}
+
+func (s *scanner) end() bool {
+	s.spaces()
+	return s.pos >= len(s.line)
+}
+
+func (s *scanner) spaces() {
+	for s.pos < len(s.line) && s.line[s.pos] == ' ' {
+		s.pos++
+	}
+}
+
+func (s *scanner) consume(c byte) bool {
+	if s.pos < len(s.line) && s.line[s.pos] == c {
+		s.pos++
+		return true
+	}
+
+	return false
+}
+
+// consumeOp consumes the operator op, not mistaking '|' for the start of '||' or '|@'
+func (s *scanner) consumeOp(op string) bool {
+	s.spaces()
+
+	if !strings.HasPrefix(s.line[s.pos:], op) {
+		return false
+	}
+
+	if op == "|" && s.pos+1 < len(s.line) && (s.line[s.pos+1] == '|' || s.line[s.pos+1] == '@') {
+		return false
+	}
+
+	s.pos += len(op)
+
+	return true
+}
+
+func (s *scanner) ident() string {
+	start := s.pos
+
+	for s.pos < len(s.line) && isVarChar(s.line[s.pos], true) {
+		s.pos++
+	}
+
+	return s.line[start:s.pos]
+}
+
+// value reads an evalString, a path stops at an unescaped space, ':' or '|'
+func (s *scanner) value(path bool) (evalString, error) {
+	var buf evalString
+	var literal bytes.Buffer
+
+	flush := func() {
+		if literal.Len() > 0 {
+			buf = append(buf, token{value: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for s.pos < len(s.line) {
+		c := s.line[s.pos]
+		if path && (c == ' ' || c == ':' || c == '|') {
+			break
+		}
+		if c != '$' {
+			literal.WriteByte(c)
+			s.pos++
+			continue
+		}
+		s.pos++
+		if s.pos >= len(s.line) {
+			return nil, errors.New("unexpected end of line after '$'")
+		}
+		c = s.line[s.pos]
+		switch {
+		case c == '$' || c == ' ' || c == ':':
+			literal.WriteByte(c)
+			s.pos++
+		case c == '{':
+			end := strings.IndexByte(s.line[s.pos:], '}')
+			if end < 0 {
+				return nil, errors.New("unterminated '${'")
+			}
+			name := s.line[s.pos+1 : s.pos+end]
+			for i := 0; i < len(name); i++ {
+				if !isVarChar(name[i], true) {
+					return nil, errors.New("invalid variable name '" + name + "'")
+				}
+			}
+			flush()
+			buf = append(buf, token{value: name, isVar: true})
+			s.pos += end + 1
+		case isVarChar(c, false):
+			start := s.pos
+			for s.pos < len(s.line) && isVarChar(s.line[s.pos], false) {
+				s.pos++
+			}
+			flush()
+			buf = append(buf, token{value: s.line[start:s.pos], isVar: true})
+		default:
+			return nil, errors.New("bad $-escape (literal $ must be written as $$)")
+		}
+	}
+
+	flush()
+
+	return buf, nil
+}
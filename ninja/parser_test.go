@@ -0,0 +1,100 @@
+package ninja
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeManifest(t *testing.T, dir, name, data string) string {
+	p := filepath.Join(dir, name)
+
+	err := os.WriteFile(p, []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	return p
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+
+	writeManifest(t, dir, "rules.ninja", `
+rule cc
+  command = $cc $flags -c $in -o $out $
+      -MF $depfile
+  depfile = $out.d
+  pool = heavy
+`)
+
+	writeManifest(t, dir, "sub.ninja", `
+flags = -O2
+build sub.o: cc sub.c
+`)
+
+	name := writeManifest(t, dir, "build.ninja", `# comment
+cc = gcc
+flags = -g
+pool heavy
+  depth = 2
+
+include rules.ninja
+subninja sub.ninja
+
+build a.o | a.d: cc a.c | a.h || gen |@ check
+  flags = ${flags} -Wall
+build gen: phony
+build all: phony a.o sub.o
+default all
+`)
+
+	m, err := Parse(name, dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(m.Edges))
+	assert.Equal(t, 2, m.Pools["heavy"])
+	assert.Equal(t, []string{"all"}, m.Defaults)
+
+	sub := m.Edges[0]
+	assert.Equal(t, "gcc -O2 -c sub.c -o sub.o -MF sub.o.d", sub.Command)
+
+	a := m.Edges[1]
+	assert.Equal(t, "cc", a.Rule)
+	assert.Equal(t, []string{"a.o"}, a.Outputs)
+	assert.Equal(t, []string{"a.d"}, a.ImplicitOutputs)
+	assert.Equal(t, []string{"a.c"}, a.Inputs)
+	assert.Equal(t, []string{"a.h"}, a.Implicit)
+	assert.Equal(t, []string{"gen"}, a.OrderOnly)
+	assert.Equal(t, []string{"check"}, a.Validations)
+	assert.Equal(t, "gcc -g -Wall -c a.c -o a.o -MF a.o.d", a.Command)
+	assert.Equal(t, "a.o.d", a.Depfile)
+	assert.Equal(t, "heavy", a.Pool)
+
+	assert.Equal(t, "phony", m.Edges[2].Rule)
+	assert.Equal(t, []string{"a.o", "sub.o"}, m.Edges[3].Inputs)
+
+	price := writeManifest(t, dir, "price.ninja", "price = $$5$:$ x\nrule echo\n  command = echo $price\nbuild out: echo\n")
+
+	m, err = Parse(price, dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "echo $5: x", m.Edges[0].Command)
+}
+
+func TestParseError(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []string{
+		"build a: missing b\n",
+		"rule cc\n  description = cc\n",
+		"rule cc\n  command = cc\nrule cc\n  command = cc\n",
+		"rule cc\n  command = cc\nbuild a: cc b\n  pool = unknown\n",
+		"x = $!\n",
+		"  x = 1\n",
+	}
+
+	for _, item := range tests {
+		name := writeManifest(t, dir, "build.ninja", item)
+		_, err := Parse(name, dir)
+		assert.NotEqual(t, nil, err, item)
+	}
+}
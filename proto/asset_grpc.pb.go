@@ -19,7 +19,11 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	AssetService_SendAsset_FullMethodName = "/asset.AssetService/SendAsset"
+	AssetService_FindMissing_FullMethodName        = "/asset.AssetService/FindMissing"
+	AssetService_Upload_FullMethodName             = "/asset.AssetService/Upload"
+	AssetService_Download_FullMethodName           = "/asset.AssetService/Download"
+	AssetService_GetActionResult_FullMethodName    = "/asset.AssetService/GetActionResult"
+	AssetService_UpdateActionResult_FullMethodName = "/asset.AssetService/UpdateActionResult"
 )
 
 // AssetServiceClient is the client API for AssetService service.
@@ -28,7 +32,11 @@ const (
 //
 // Asset service
 type AssetServiceClient interface {
-	SendAsset(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AssetRequest, AssetReply], error)
+	FindMissing(ctx context.Context, in *FindMissingRequest, opts ...grpc.CallOption) (*FindMissingReply, error)
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadReply], error)
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadReply], error)
+	GetActionResult(ctx context.Context, in *GetActionResultRequest, opts ...grpc.CallOption) (*ActionResult, error)
+	UpdateActionResult(ctx context.Context, in *UpdateActionResultRequest, opts ...grpc.CallOption) (*ActionResult, error)
 }
 
 type assetServiceClient struct {
@@ -39,18 +47,67 @@ func NewAssetServiceClient(cc grpc.ClientConnInterface) AssetServiceClient {
 	return &assetServiceClient{cc}
 }
 
-func (c *assetServiceClient) SendAsset(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AssetRequest, AssetReply], error) {
+func (c *assetServiceClient) FindMissing(ctx context.Context, in *FindMissingRequest, opts ...grpc.CallOption) (*FindMissingReply, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	stream, err := c.cc.NewStream(ctx, &AssetService_ServiceDesc.Streams[0], AssetService_SendAsset_FullMethodName, cOpts...)
+	out := new(FindMissingReply)
+	err := c.cc.Invoke(ctx, AssetService_FindMissing_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &grpc.GenericClientStream[AssetRequest, AssetReply]{ClientStream: stream}
+	return out, nil
+}
+
+func (c *assetServiceClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadReply], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AssetService_ServiceDesc.Streams[0], AssetService_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, UploadReply]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AssetService_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadReply]
+
+func (c *assetServiceClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadReply], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AssetService_ServiceDesc.Streams[1], AssetService_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadReply]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
 	return x, nil
 }
 
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
-type AssetService_SendAssetClient = grpc.BidiStreamingClient[AssetRequest, AssetReply]
+type AssetService_DownloadClient = grpc.ServerStreamingClient[DownloadReply]
+
+func (c *assetServiceClient) GetActionResult(ctx context.Context, in *GetActionResultRequest, opts ...grpc.CallOption) (*ActionResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ActionResult)
+	err := c.cc.Invoke(ctx, AssetService_GetActionResult_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *assetServiceClient) UpdateActionResult(ctx context.Context, in *UpdateActionResultRequest, opts ...grpc.CallOption) (*ActionResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ActionResult)
+	err := c.cc.Invoke(ctx, AssetService_UpdateActionResult_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
 // AssetServiceServer is the server API for AssetService service.
 // All implementations must embed UnimplementedAssetServiceServer
@@ -58,7 +115,11 @@ type AssetService_SendAssetClient = grpc.BidiStreamingClient[AssetRequest, Asset
 //
 // Asset service
 type AssetServiceServer interface {
-	SendAsset(grpc.BidiStreamingServer[AssetRequest, AssetReply]) error
+	FindMissing(context.Context, *FindMissingRequest) (*FindMissingReply, error)
+	Upload(grpc.ClientStreamingServer[UploadRequest, UploadReply]) error
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadReply]) error
+	GetActionResult(context.Context, *GetActionResultRequest) (*ActionResult, error)
+	UpdateActionResult(context.Context, *UpdateActionResultRequest) (*ActionResult, error)
 	mustEmbedUnimplementedAssetServiceServer()
 }
 
@@ -69,8 +130,20 @@ type AssetServiceServer interface {
 // pointer dereference when methods are called.
 type UnimplementedAssetServiceServer struct{}
 
-func (UnimplementedAssetServiceServer) SendAsset(grpc.BidiStreamingServer[AssetRequest, AssetReply]) error {
-	return status.Errorf(codes.Unimplemented, "method SendAsset not implemented")
+func (UnimplementedAssetServiceServer) FindMissing(context.Context, *FindMissingRequest) (*FindMissingReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindMissing not implemented")
+}
+func (UnimplementedAssetServiceServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadReply]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedAssetServiceServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadReply]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedAssetServiceServer) GetActionResult(context.Context, *GetActionResultRequest) (*ActionResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetActionResult not implemented")
+}
+func (UnimplementedAssetServiceServer) UpdateActionResult(context.Context, *UpdateActionResultRequest) (*ActionResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateActionResult not implemented")
 }
 func (UnimplementedAssetServiceServer) mustEmbedUnimplementedAssetServiceServer() {}
 func (UnimplementedAssetServiceServer) testEmbeddedByValue()                      {}
@@ -93,12 +166,77 @@ func RegisterAssetServiceServer(s grpc.ServiceRegistrar, srv AssetServiceServer)
 	s.RegisterService(&AssetService_ServiceDesc, srv)
 }
 
-func _AssetService_SendAsset_Handler(srv interface{}, stream grpc.ServerStream) error {
-	return srv.(AssetServiceServer).SendAsset(&grpc.GenericServerStream[AssetRequest, AssetReply]{ServerStream: stream})
+func _AssetService_FindMissing_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FindMissingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssetServiceServer).FindMissing(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AssetService_FindMissing_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssetServiceServer).FindMissing(ctx, req.(*FindMissingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AssetService_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AssetServiceServer).Upload(&grpc.GenericServerStream[UploadRequest, UploadReply]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AssetService_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadReply]
+
+func _AssetService_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AssetServiceServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadReply]{ServerStream: stream})
 }
 
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
-type AssetService_SendAssetServer = grpc.BidiStreamingServer[AssetRequest, AssetReply]
+type AssetService_DownloadServer = grpc.ServerStreamingServer[DownloadReply]
+
+func _AssetService_GetActionResult_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetActionResultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssetServiceServer).GetActionResult(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AssetService_GetActionResult_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssetServiceServer).GetActionResult(ctx, req.(*GetActionResultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AssetService_UpdateActionResult_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateActionResultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssetServiceServer).UpdateActionResult(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AssetService_UpdateActionResult_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssetServiceServer).UpdateActionResult(ctx, req.(*UpdateActionResultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
 
 // AssetService_ServiceDesc is the grpc.ServiceDesc for AssetService service.
 // It's only intended for direct use with grpc.RegisterService,
@@ -106,14 +244,31 @@ type AssetService_SendAssetServer = grpc.BidiStreamingServer[AssetRequest, Asset
 var AssetService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "asset.AssetService",
 	HandlerType: (*AssetServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "FindMissing",
+			Handler:    _AssetService_FindMissing_Handler,
+		},
+		{
+			MethodName: "GetActionResult",
+			Handler:    _AssetService_GetActionResult_Handler,
+		},
+		{
+			MethodName: "UpdateActionResult",
+			Handler:    _AssetService_UpdateActionResult_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
-			StreamName:    "SendAsset",
-			Handler:       _AssetService_SendAsset_Handler,
-			ServerStreams: true,
+			StreamName:    "Upload",
+			Handler:       _AssetService_Upload_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Download",
+			Handler:       _AssetService_Download_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "asset.proto",
 }
@@ -4,22 +4,33 @@ import (
 	"bufio"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"io"
-	"math"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
+	"distbuild/boong/proxy/cache"
+	"distbuild/boong/proxy/cas"
 	"distbuild/boong/proxy/consul"
+	"distbuild/boong/proxy/discovery"
+	"distbuild/boong/proxy/dispatch"
+	"distbuild/boong/proxy/local"
+	"distbuild/boong/proxy/ninja"
 	"distbuild/boong/proxy/proto"
 	"distbuild/boong/proxy/task"
 	"distbuild/boong/utils"
@@ -35,8 +46,38 @@ var (
 
 const (
 	buildTimeout = 30 * time.Minute
+	chunkSize    = 1024 * 1024
+	defaultJobs  = 1
+
+	localWorkerName = "local"
+
+	formatAuto   = "auto"
+	formatSoong  = "soong"
+	formatNinja  = "ninja"
+	formatCompdb = "compdb"
 )
 
+// remoteWorker sends tasks to one worker over its build and asset services
+type remoteWorker struct {
+	client        proto.BuildServiceClient
+	assets        proto.AssetServiceClient
+	uploader      *cas.Uploader
+	digester      *cas.Digester
+	noActionCache atomic.Bool
+}
+
+// BuildError is returned when a worker reports a failed build
+type BuildError struct {
+	Build    *task.BuildInfo
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("build %s failed with exit code %d", strings.Join(e.Build.BuildTargets, " "), e.ExitCode)
+}
+
 type NormalService struct {
 	Name string `json:"ServiceName"`
 }
@@ -46,9 +87,31 @@ type ConsulService struct {
 }
 
 var (
-	compileFile     string
-	listenAddresses []string
-	workSpacePath   string
+	outputMutex sync.Mutex
+)
+
+var (
+	compileFile   string
+	ninjaFile     string
+	taskFormat    string
+	excludes      []string
+	jobs          int
+	keepGoing     bool
+	retries       int
+	retryBackoff  time.Duration
+	localJobs     int
+	noCache       bool
+	cacheDir      string
+	cacheSize     string
+	noRemoteCache bool
+	workerAddrs   []string
+	workersFile   string
+	workersSRV    string
+	consulCfg     = consul.DefaultConfig()
+	workers       []discovery.Worker
+	workerSource  discovery.Discovery
+	workSpacePath string
+	lintJSON      bool
 )
 
 var rootCmd = &cobra.Command{
@@ -61,17 +124,17 @@ var rootCmd = &cobra.Command{
 			_, _ = fmt.Fprintln(os.Stderr, err.Error())
 			os.Exit(1)
 		}
-		consulService, exists := os.LookupEnv("CONSUL_SERVICE")
-		if !exists {
-			_, _ = fmt.Fprintln(os.Stderr, "CONSUL_SERVICE environment variable not set")
-			os.Exit(1)
-		}
+		consulService := os.Getenv("CONSUL_SERVICE")
 		if err := validArgs(ctx, consulService); err != nil {
 			_, _ = fmt.Fprintln(os.Stderr, err.Error())
 			os.Exit(1)
 		}
 		if err := run(ctx); err != nil {
 			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			var buildErr *BuildError
+			if errors.As(err, &buildErr) {
+				os.Exit(buildErr.ExitCode)
+			}
 			os.Exit(1)
 		}
 	},
@@ -83,12 +146,102 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVarP(&workSpacePath, "workspace-path", "w", "", "workspace path")
 	rootCmd.PersistentFlags().StringVarP(&compileFile, "compile-file", "c", "", "path to compile file")
+	rootCmd.PersistentFlags().StringVar(&ninjaFile, "ninja-file", "", "path to build.ninja, instead of compile file")
+	rootCmd.PersistentFlags().StringSliceVar(&excludes, "exclude", nil, "gitignore-style patterns of include files not to send, on top of "+task.IgnoreName)
+	rootCmd.PersistentFlags().StringVar(&taskFormat, "format", formatAuto, "compile file format (soong, ninja, compdb, auto)")
+	rootCmd.PersistentFlags().StringSliceVar(&workerAddrs, "workers", nil, "static worker addresses (host:port), instead of Consul")
+	rootCmd.PersistentFlags().StringVar(&workersFile, "workers-file", "", "file of worker addresses watched for changes, instead of Consul")
+	rootCmd.PersistentFlags().StringVar(&workersSRV, "workers-srv", "", "DNS SRV name of the workers, instead of Consul")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.Service, "worker-service", "", "Consul service name of the workers (empty: every passing service with --worker-tags)")
+	rootCmd.PersistentFlags().StringSliceVar(&consulCfg.Tags, "worker-tags", nil, "Consul tags every worker service must have, required without --worker-service")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.Policy, "worker-policy", consulCfg.Policy, "admission rules over Consul worker metadata, e.g. disk>=500GB,cpu>=16,memory>=64GB,age<=30d")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.Scheme, "consul-scheme", consulCfg.Scheme, "Consul API scheme (http, https)")
+	rootCmd.PersistentFlags().IntVar(&consulCfg.Port, "consul-port", consulCfg.Port, "Consul API port")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.CAFile, "consul-ca", "", "CA bundle of the Consul server certificate")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.CertFile, "consul-cert", "", "client certificate for Consul")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.KeyFile, "consul-key", "", "client key for Consul")
+	rootCmd.PersistentFlags().StringVar(&consulCfg.Datacenter, "consul-datacenter", "", "Consul datacenter of the workers (empty: the agent's own)")
+	rootCmd.PersistentFlags().StringSliceVar(&consulCfg.FallbackDatacenters, "consul-fallback-datacenters", nil, "Consul datacenters asked in order when the first has no workers")
+	rootCmd.PersistentFlags().BoolVarP(&keepGoing, "keep-going", "k", false, "keep going until independent tasks are done")
+	rootCmd.PersistentFlags().IntVar(&retries, "retries", 2, "retries on other workers after transport errors")
+	rootCmd.PersistentFlags().DurationVar(&retryBackoff, "retry-backoff", time.Second, "initial backoff between retries")
+	rootCmd.PersistentFlags().IntVar(&localJobs, "local-jobs", runtime.NumCPU(), "concurrent local builds when no worker can take a task (0: disabled)")
+	rootCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 0, "concurrent builds per worker (0: derived from worker cpu)")
+
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "disable the local action cache")
+	rootCmd.PersistentFlags().BoolVar(&noRemoteCache, "no-remote-cache", false, "disable the shared action cache of workers")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", cache.DefaultConfig().Dir, "local action cache directory")
+	rootCmd.PersistentFlags().StringVar(&cacheSize, "cache-size", "10G", "local action cache size cap")
 
-	_ = rootCmd.MarkFlagRequired("workspace-path")
+	cacheCmd.AddCommand(cacheStatsCmd, cacheCleanCmd)
+	rootCmd.AddCommand(cacheCmd)
+
+	lintCmd.Flags().BoolVar(&lintJSON, "json", false, "print issues as JSON")
+	rootCmd.AddCommand(lintCmd)
 
 	rootCmd.Root().CompletionOptions.DisableDefaultCmd = true
 }
 
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "manage the local action cache",
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show local action cache stats",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		c, err := newActionCache(ctx)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		stats, err := c.Stats(ctx)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Directory: %s\nEntries: %d\nSize: %d/%d bytes\n", stats.Dir, stats.Entries, stats.Size, stats.MaxSize)
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "remove all local action cache entries",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		c, err := newActionCache(ctx)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		if err := c.Clean(ctx); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "validate the commands of a compile file",
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := lintCompileFile()
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		if err := printLint(os.Stdout, report, lintJSON); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		if len(report.Issues) != 0 {
+			os.Exit(1)
+		}
+	},
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -99,29 +252,102 @@ func isValidIP(ip string) bool {
 	return net.ParseIP(ip) != nil
 }
 
-func validArgs(_ context.Context, consulService string) error {
+func validArgs(ctx context.Context, consulService string) error {
 	var err error
 
-	if !isValidIP(consulService) {
-		return errors.New("invalid Ip format\n")
+	if len(workSpacePath) == 0 {
+		return errors.New("invalid workspace path\n")
 	}
 
-	listenAddresses, err = consul.GetListenAddresses(consulService)
+	if localJobs < 0 {
+		return errors.New("invalid local jobs\n")
+	}
+
+	workerSource, err = newDiscovery(ctx, consulService)
 	if err != nil {
-		return errors.New("failed to get worker listen address")
+		return err
 	}
 
-	if len(listenAddresses) == 0 {
+	if workerSource == nil {
+		log.Printf("no worker discovery configured, building locally\n")
+	} else if workers, err = workerSource.Workers(ctx); err != nil {
+		if localJobs == 0 {
+			return errors.New("failed to get worker listen address")
+		}
+		log.Printf("failed to get worker listen address, building locally: %v\n", err)
+	}
+
+	if len(workers) == 0 && localJobs == 0 {
 		return errors.New("invalid listen address")
 	}
 
-	if len(compileFile) == 0 {
+	if jobs < 0 {
+		return errors.New("invalid jobs\n")
+	}
+
+	if retries < 0 || retryBackoff < 0 {
+		return errors.New("invalid retry policy\n")
+	}
+
+	if len(compileFile) == 0 && len(ninjaFile) == 0 {
 		return errors.New("invalid compileFile\n")
 	}
 
+	if len(compileFile) != 0 && len(ninjaFile) != 0 {
+		return errors.New("compile file and ninja file are exclusive\n")
+	}
+
+	switch taskFormat {
+	case formatAuto, formatSoong, formatNinja, formatCompdb:
+	default:
+		return errors.New("invalid format\n")
+	}
+
 	return nil
 }
 
+// newDiscovery returns the worker discovery backend given on the command line, Consul
+// when CONSUL_SERVICE is set otherwise, and nil when there is none
+func newDiscovery(ctx context.Context, consulService string) (discovery.Discovery, error) {
+	given := 0
+	for _, item := range []bool{len(workerAddrs) != 0, len(workersFile) != 0, len(workersSRV) != 0} {
+		if item {
+			given++
+		}
+	}
+
+	if given > 1 {
+		return nil, errors.New("workers, workers file and workers srv are exclusive\n")
+	}
+
+	switch {
+	case len(workerAddrs) != 0:
+		source, err := discovery.NewStatic(workerAddrs)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid workers\n")
+		}
+		return source, nil
+	case len(workersFile) != 0:
+		return discovery.NewFile(workersFile, discovery.DefaultInterval), nil
+	case len(workersSRV) != 0:
+		return discovery.NewDNS(workersSRV, discovery.DefaultInterval), nil
+	case len(consulService) != 0:
+		if !isValidIP(consulService) {
+			return nil, errors.New("invalid Ip format\n")
+		}
+		cfg := *consulCfg
+		cfg.Address = consulService
+		cfg.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+		source, err := discovery.NewConsul(ctx, &cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid consul config\n")
+		}
+		return source, nil
+	}
+
+	return nil, nil
+}
+
 func loadEnvFile(content string) error {
 	scanner := bufio.NewScanner(strings.NewReader(content))
 
@@ -152,29 +378,63 @@ func loadEnvFile(content string) error {
 
 func run(ctx context.Context) error {
 	options := []grpc.DialOption{
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 	}
 
-	var clients []proto.BuildServiceClient
+	var clients []*dispatch.Worker
 	var conns []*grpc.ClientConn
+	var connsMutex sync.Mutex
 	var errs []error
 
-	for _, addr := range listenAddresses {
-		conn, err := grpc.NewClient(addr, options...)
+	digester := cas.NewDigester(workSpacePath)
+
+	var actions cache.Cache
+	if !noCache {
+		c, err := newActionCache(ctx)
 		if err != nil {
-			errs = append(errs, errors.Wrap(err, "failed to create grpc client for address: "+addr))
-			continue
+			return errors.Wrap(err, "failed to create action cache\n")
+		}
+		actions = c
+	}
+
+	deps, err := task.OpenDepDB(workSpacePath)
+	if err != nil {
+		log.Printf("failed to open dependency database: %v\n", err)
+	}
+
+	defer func(deps *task.DepDB) {
+		if err := deps.Save(); err != nil {
+			log.Printf("failed to save dependency database: %v\n", err)
 		}
+	}(deps)
+
+	connect := func(item discovery.Worker) (*dispatch.Worker, error) {
+		conn, err := grpc.NewClient(item.Address, options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create grpc client for address: "+item.Address)
+		}
+		connsMutex.Lock()
 		conns = append(conns, conn)
-		clients = append(clients, proto.NewBuildServiceClient(conn))
+		connsMutex.Unlock()
+		return newWorker(item, conn, digester, actions, deps), nil
+	}
+
+	for _, item := range workers {
+		worker, err := connect(item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		clients = append(clients, worker)
 	}
 
 	if len(clients) == 0 {
 		for _, err := range errs {
 			fmt.Println(err)
 		}
-		return errors.New("failed to connect to any address")
+		if localJobs == 0 {
+			return errors.New("failed to connect to any address")
+		}
 	}
 
 	defer func() {
@@ -183,18 +443,264 @@ func run(ctx context.Context) error {
 		}
 	}()
 
-	if err := sendBuild(ctx, clients); err != nil {
+	var fallback *dispatch.Worker
+	if localJobs > 0 {
+		fallback = newLocalWorker(digester, actions, deps)
+	}
+
+	var changes <-chan dispatch.Change
+	if workerSource != nil {
+		watchCtx, cancel := context.WithCancel(ctx)
+		changes = watchWorkers(watchCtx, workerSource, connect)
+		// the watch is over before the connections it opened are closed
+		defer func() {
+			cancel()
+			for range changes {
+			}
+		}()
+	}
+
+	if err := sendBuild(ctx, clients, fallback, changes); err != nil {
 		return errors.Wrap(err, "failed to send build")
 	}
 
 	return nil
 }
 
-func sendBuild(ctx context.Context, clients []proto.BuildServiceClient) error {
+// watchWorkers connects to the workers joining during the build and drains those
+// leaving, until ctx is done
+func watchWorkers(ctx context.Context, source discovery.Discovery, connect func(discovery.Worker) (*dispatch.Worker, error)) <-chan dispatch.Change {
+	changes := make(chan dispatch.Change)
+
+	go func() {
+		defer close(changes)
+
+		for event := range source.Watch(ctx) {
+			change := dispatch.Change{
+				Worker: &dispatch.Worker{Name: event.Worker.Address},
+				Remove: true,
+			}
+
+			if event.Type == discovery.EventAdd {
+				worker, err := connect(event.Worker)
+				if err != nil {
+					log.Printf("failed to connect to joining worker: %v\n", err)
+					continue
+				}
+				change = dispatch.Change{Worker: worker}
+				log.Printf("Worker joined: %s\n", event.Worker.Address)
+			} else {
+				log.Printf("Worker left: %s\n", event.Worker.Address)
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes
+}
+
+func newWorker(worker discovery.Worker, conn *grpc.ClientConn, digester *cas.Digester, actions cache.Cache, deps *task.DepDB) *dispatch.Worker {
+	assets := proto.NewAssetServiceClient(conn)
+
+	remote := &remoteWorker{
+		client:   proto.NewBuildServiceClient(conn),
+		assets:   assets,
+		uploader: cas.NewUploader(assets, digester),
+		digester: digester,
+	}
+
+	slots := jobs
+	if slots == 0 {
+		slots = worker.Cores
+	}
+	if slots == 0 {
+		slots = defaultJobs
+	}
+
+	return &dispatch.Worker{
+		Name:  worker.Address,
+		Slots: slots,
+		Exec:  withDeps(deps, withCache(actions, digester, remote.build)),
+	}
+}
+
+func newActionCache(ctx context.Context) (cache.Cache, error) {
+	size, err := cache.ParseSize(cacheSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cache size\n")
+	}
+
+	cfg := cache.DefaultConfig()
+	cfg.Dir = cacheDir
+	cfg.MaxSize = size
+
+	return cache.New(ctx, cfg), nil
+}
+
+// actionKey digests a task independently of the absolute workspace path, along with
+// the prebuilt compiler its rule was normalized from
+func actionKey(digester *cas.Digester, build *task.BuildInfo) (string, error) {
+	var inputs []cache.Input
+
+	if build.Toolchain != "" {
+		// a prebuilt missing from the workspace is told apart by its versioned path
+		toolchain := cache.Input{Path: build.Toolchain}
+		if digest, err := digester.Digest(build.Toolchain); err == nil {
+			toolchain.Checksum = digest.Hash
+		}
+		inputs = append(inputs, toolchain)
+	}
+
+	for _, item := range build.BuildFiles {
+		digest, err := digester.Digest(item)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get digest\n")
+		}
+		inputs = append(inputs, cache.Input{Path: item, Checksum: digest.Hash})
+	}
+
+	m := task.NewPrefixMap(workSpacePath)
+
+	return cache.Key(m.Apply(buildCommand(build)), inputs, build.BuildTargets), nil
+}
+
+// withCache restores targets from the action cache before building, and stores them after
+func withCache(actions cache.Cache, digester *cas.Digester, exec dispatch.ExecFunc) dispatch.ExecFunc {
+	if actions == nil {
+		return exec
+	}
+
+	return func(ctx context.Context, build *task.BuildInfo) error {
+		key, err := actionKey(digester, build)
+		if err != nil {
+			return errors.Wrap(err, "failed to get action key\n")
+		}
+
+		hit, err := actions.Get(ctx, key, workSpacePath)
+		if err != nil {
+			log.Printf("failed to read action cache: %v\n", err)
+		}
+
+		if hit {
+			log.Printf("Cache hit: %s\n", strings.Join(build.BuildTargets, " "))
+			return nil
+		}
+
+		if err := exec(ctx, build); err != nil {
+			return err
+		}
+
+		if err := actions.Put(ctx, key, workSpacePath, build.BuildTargets); err != nil {
+			log.Printf("failed to write action cache: %v\n", err)
+		}
+
+		return nil
+	}
+}
+
+// withDeps records the inputs the depfile of a task reports once it is built
+func withDeps(deps *task.DepDB, exec dispatch.ExecFunc) dispatch.ExecFunc {
+	if deps == nil {
+		return exec
+	}
+
+	return func(ctx context.Context, build *task.BuildInfo) error {
+		if err := exec(ctx, build); err != nil {
+			return err
+		}
+
+		if build.Depfile == "" || len(build.BuildTargets) == 0 {
+			return nil
+		}
+
+		if err := recordDeps(deps, build); err != nil {
+			log.Printf("failed to record dependencies of %s: %v\n", build.BuildTargets[0], err)
+		}
+
+		return nil
+	}
+}
+
+// recordDeps maps the depfile inputs to the workspace, inputs outside of it are left out
+func recordDeps(deps *task.DepDB, build *task.BuildInfo) error {
+	data, err := os.ReadFile(filepath.Join(workSpacePath, build.Depfile))
+	if err != nil {
+		return errors.Wrap(err, "failed to read depfile\n")
+	}
+
+	_, inputs, err := task.ParseDepfile(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse depfile\n")
+	}
+
+	m := task.NewPrefixMap(workSpacePath)
+
+	var buf []string
+
+	for _, item := range inputs {
+		rel := filepath.Join(build.BuildPath, item)
+		if filepath.IsAbs(item) {
+			rel = m.Rel(item)
+		}
+		if filepath.IsAbs(rel) || !filepath.IsLocal(rel) {
+			continue
+		}
+		buf = append(buf, filepath.Clean(rel))
+	}
+
+	return deps.Record(workSpacePath, build.BuildTargets[0], build.BuildRule, buf)
+}
+
+// newLocalWorker runs tasks no remote worker could take in the workspace
+func newLocalWorker(digester *cas.Digester, actions cache.Cache, deps *task.DepDB) *dispatch.Worker {
+	return &dispatch.Worker{
+		Name:  localWorkerName,
+		Slots: localJobs,
+		Exec:  withDeps(deps, withCache(actions, digester, buildLocalTask)),
+	}
+}
+
+func sendBuild(ctx context.Context, clients []*dispatch.Worker, fallback *dispatch.Worker, changes <-chan dispatch.Change) error {
 	ctx, cancel := context.WithTimeout(ctx, buildTimeout)
 	defer cancel()
 
-	buf, err := task.CompileDependency(workSpacePath, compileFile)
+	source, err := newTaskSource(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to create task source\n")
+	}
+
+	cfg := dispatch.DefaultConfig()
+	cfg.KeepGoing = keepGoing
+	cfg.Retries = retries
+	cfg.Backoff = retryBackoff
+	cfg.Retryable = isTransportError
+	cfg.Fallback = fallback
+	cfg.Changes = changes
+	cfg.Exists = func(name string) bool {
+		_, err := os.Stat(filepath.Join(workSpacePath, name))
+		return err == nil
+	}
+
+	d := dispatch.New(ctx, cfg)
+
+	if stream, ok := source.(task.StreamSource); ok {
+		// consumers streamed before their producer wait for it, even with a stale file on disk
+		outputs, err := stream.Outputs(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse compile task\n")
+		}
+		cfg.Produced = func(name string) bool {
+			return outputs[filepath.Clean(name)]
+		}
+		return streamBuild(ctx, d, clients, stream)
+	}
+
+	buf, err := source.Load(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse compile task\n")
 	}
@@ -203,62 +709,495 @@ func sendBuild(ctx context.Context, clients []proto.BuildServiceClient) error {
 		return errors.New("no build tasks to process")
 	}
 
-	for i, item := range buf {
-		client := clients[i%len(clients)]
-		stream, err := client.SendBuild(ctx)
+	graph, err := task.NewGraph(buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve task dependencies\n")
+	}
+
+	report, err := d.Run(ctx, clients, graph)
+	if keepGoing {
+		printSummary(graph, report)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to dispatch build\n")
+	}
+
+	return nil
+}
+
+// streamBuild dispatches tasks while the source is still decoding them, malformed
+// entries are reported as they come and fail the build once it is done
+func streamBuild(ctx context.Context, d dispatch.Dispatcher, clients []*dispatch.Worker, source task.StreamSource) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tasks, errs := source.Stream(ctx)
+
+	var sourceErr error
+	var malformed int
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for err := range errs {
+			if _, ok := err.(*task.EntryError); ok {
+				log.Printf("Skipping malformed command: %v\n", err)
+				malformed++
+				continue
+			}
+			sourceErr = err
+			cancel()
+		}
+	}()
+
+	graph, report, err := d.RunStream(ctx, clients, tasks)
+
+	cancel()
+	<-done
+
+	if keepGoing {
+		printSummary(graph, report)
+	}
+
+	if sourceErr != nil {
+		return errors.Wrap(sourceErr, "failed to parse compile task\n")
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to dispatch build\n")
+	}
+
+	if malformed > 0 {
+		return errors.Errorf("%d malformed commands skipped\n", malformed)
+	}
+
+	if len(graph.Nodes) == 0 {
+		return errors.New("no build tasks to process")
+	}
+
+	return nil
+}
+
+// newTaskSource picks the task source from --format, sniffing the compile file on auto
+func newTaskSource(_ context.Context) (task.Source, error) {
+	name := compileFile
+	format := taskFormat
+
+	if len(ninjaFile) != 0 {
+		name, format = ninjaFile, formatNinja
+	}
+
+	name, err := compilePath(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get compile file path\n")
+	}
+
+	opts := &task.Options{
+		Exclude: excludes,
+	}
+
+	if format == formatAuto {
+		f, err := detectFormat(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to detect format\n")
+		}
+		format = f
+	}
+
+	switch format {
+	case formatSoong:
+		return task.NewSoongSource(workSpacePath, name, opts), nil
+	case formatCompdb:
+		return task.NewCompdbSource(workSpacePath, name, opts), nil
+	case formatNinja:
+		cfg := ninja.DefaultConfig()
+		cfg.Dir = filepath.Dir(name)
+		return ninja.NewSource(cfg, name, workSpacePath, opts), nil
+	default:
+		return nil, errors.New("invalid format " + format + "\n")
+	}
+}
+
+// compilePath resolves a compile file to an absolute path, looking it up under the out
+// directory of the workspace, as soong writes them, unless it exists as given
+func compilePath(name string) (string, error) {
+	if _, err := os.Stat(name); err != nil && !filepath.IsAbs(name) {
+		name = filepath.Join(workSpacePath, "out", name)
+	}
+
+	return filepath.Abs(name)
+}
+
+// lintCompileFile validates the commands of the soong compile file
+func lintCompileFile() (*task.LintReport, error) {
+	if len(workSpacePath) == 0 {
+		return nil, errors.New("invalid workspace path\n")
+	}
+
+	if len(compileFile) == 0 {
+		return nil, errors.New("invalid compileFile\n")
+	}
+
+	name, err := compilePath(compileFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get compile file path\n")
+	}
+
+	format := taskFormat
+
+	if format == formatAuto {
+		f, err := detectFormat(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to detect format\n")
+		}
+		format = f
+	}
+
+	if format != formatSoong {
+		return nil, errors.New("lint supports soong compile files only, not " + format + "\n")
+	}
+
+	report, err := task.Lint(workSpacePath, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lint compile file\n")
+	}
+
+	return report, nil
+}
+
+// printLint writes the issues of a lint report, one per line or as JSON
+func printLint(w io.Writer, report *task.LintReport, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	for _, item := range report.Issues {
+		_, _ = fmt.Fprintf(w, "%s: command %d at offset %d: %s: %s\n", report.File, item.Index, item.Offset, item.Kind, item.Message)
+	}
+
+	_, _ = fmt.Fprintf(w, "%d commands, %d issues\n", report.Commands, len(report.Issues))
+
+	return nil
+}
+
+// detectFormat tells the formats apart by extension, then by the first JSON token
+func detectFormat(name string) (string, error) {
+	if filepath.Ext(name) == ".ninja" {
+		return formatNinja, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open file\n")
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	reader := bufio.NewReader(file)
+
+	for {
+		c, err := reader.ReadByte()
 		if err != nil {
-			return errors.Wrap(err, "failed to send client build\n")
+			return formatNinja, nil
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return formatCompdb, nil
+		case '{':
+			return formatSoong, nil
+		default:
+			return formatNinja, nil
+		}
+	}
+}
+
+// buildCommand runs the rule from the build path of the task, relative to the workspace
+func buildCommand(build *task.BuildInfo) string {
+	if build.BuildPath == "" {
+		return build.BuildRule
+	}
+
+	return "cd " + shellQuote(filepath.ToSlash(build.BuildPath)) + " && " + build.BuildRule
+}
+
+func shellQuote(s string) string {
+	if !strings.ContainsAny(s, " '\"\\$`&|;<>()*?[]#~") {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isTransportError reports whether err is a transient grpc failure worth retrying on another worker
+func isTransportError(err error) bool {
+	var buildErr *BuildError
+	if errors.As(err, &buildErr) {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// printSummary prints failed commands and the dependents skipped because of them
+func printSummary(graph *task.Graph, report *dispatch.Report) {
+	failed := report.Nodes(dispatch.StatusFailed)
+	skipped := report.Nodes(dispatch.StatusSkipped)
+
+	if len(failed) == 0 && len(skipped) == 0 {
+		return
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	_, _ = fmt.Fprintf(os.Stderr, "\nBuild summary: %d done, %d failed, %d skipped\n",
+		len(report.Nodes(dispatch.StatusDone)), len(failed), len(skipped))
+
+	if len(failed) > 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed commands:")
+		for _, item := range failed {
+			_, _ = fmt.Fprintf(os.Stderr, "  %s [%s]\n    %s\n", graph.Label(item), report.Results[item].Worker, graph.Nodes[item].Task.BuildRule)
+		}
+	}
+
+	if len(skipped) > 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "Skipped dependents:")
+		for _, item := range skipped {
+			_, _ = fmt.Fprintf(os.Stderr, "  %s (depends on %s)\n", graph.Label(item), graph.Label(report.Results[item].Cause))
+		}
+	}
+}
+
+// build checks the shared action cache of the worker, then sends the task to it
+func (w *remoteWorker) build(ctx context.Context, build *task.BuildInfo) error {
+	key, err := actionKey(w.digester, build)
+	if err != nil {
+		return errors.Wrap(err, "failed to get action key\n")
+	}
+
+	hit, err := w.cached(ctx, key, build)
+	if err != nil {
+		return err
+	}
+
+	if hit {
+		log.Printf("Remote cache hit: %s\n", strings.Join(build.BuildTargets, " "))
+		return nil
+	}
+
+	files, inline, err := uploadBuildFiles(ctx, w.uploader, build)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload build files\n")
+	}
+
+	stream, err := w.client.SendBuild(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to send client build\n")
+	}
+
+	if err := sendBuildRequest(stream, build, files, inline, key); err != nil {
+		return errors.Wrap(err, "failed to send build request\n")
+	}
+
+	if err := receiveBuildResponse(stream, build); err != nil {
+		var buildErr *BuildError
+		if errors.As(err, &buildErr) {
+			printBuildError(buildErr)
+		}
+		return errors.Wrap(err, "failed to receive build response\n")
+	}
+
+	if err := checkBuildTargets(build); err != nil {
+		return errors.Wrap(err, "failed to check build targets\n")
+	}
+
+	return nil
+}
+
+// cached fetches the outputs of build from the shared action cache. An entry that cannot
+// be read is a miss, only transport errors are returned so that the task is retried
+func (w *remoteWorker) cached(ctx context.Context, key string, build *task.BuildInfo) (bool, error) {
+	if noRemoteCache || w.noActionCache.Load() {
+		return false, nil
+	}
+
+	hit, err := w.fetchActionResult(ctx, key, build)
+
+	switch {
+	case err == nil:
+		return hit, nil
+	case cas.IsUnimplemented(err):
+		w.noActionCache.Store(true)
+	case ctx.Err() != nil || isTransportError(err):
+		return false, errors.Wrap(err, "failed to fetch action result\n")
+	default:
+		log.Printf("Ignoring action cache of %s: %v\n", task.Label(*build), err)
+	}
+
+	return false, nil
+}
+
+// fetchActionResult downloads the outputs of a cached action, returning false on a miss,
+// the outputs downloaded before an error are removed
+func (w *remoteWorker) fetchActionResult(ctx context.Context, key string, build *task.BuildInfo) (bool, error) {
+	result, err := cas.GetActionResult(ctx, w.assets, key)
+	if err != nil || result == nil || result.GetExitCode() != 0 {
+		return false, err
+	}
+
+	m := task.NewPrefixMap(workSpacePath)
+
+	outputs := map[string]*proto.OutputFile{}
+	for _, item := range result.GetOutputFiles() {
+		outputs[filepath.Clean(m.Rel(item.GetFilePath()))] = item
+	}
+
+	for _, item := range build.BuildTargets {
+		if _, ok := outputs[filepath.Clean(item)]; !ok {
+			return false, nil
 		}
+	}
 
-		if err := sendBuildRequest(stream, &item); err != nil {
-			return errors.Wrap(err, "failed to send build request\n")
+	for i, item := range build.BuildTargets {
+		output := outputs[filepath.Clean(item)]
+		mode := os.FileMode(0644)
+		if output.GetExecutable() {
+			mode = 0755
+		}
+		if err := cas.Download(ctx, w.assets, output.GetDigest(), filepath.Join(workSpacePath, item), mode); err != nil {
+			for _, name := range build.BuildTargets[:i+1] {
+				_ = os.Remove(filepath.Join(workSpacePath, name))
+			}
+			return false, errors.Wrap(err, "failed to download "+item+"\n")
+		}
+	}
+
+	return true, nil
+}
+
+// printBuildError prints the worker diagnostics against the failing command
+func printBuildError(err *BuildError) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	_, _ = fmt.Fprintf(os.Stderr, "FAILED: %s\n%s\n", strings.Join(err.Build.BuildTargets, " "), err.Build.BuildRule)
+	_, _ = os.Stderr.Write(err.Stdout)
+	_, _ = os.Stderr.Write(err.Stderr)
+}
+
+func buildLocalTask(ctx context.Context, build *task.BuildInfo) error {
+	log.Printf("Local build: %s\n", strings.Join(build.BuildTargets, " "))
+
+	ret, err := local.Run(ctx, filepath.Join(workSpacePath, build.BuildPath), build.BuildRule)
+	if err != nil {
+		return errors.Wrap(err, "failed to run local build\n")
+	}
+
+	if ret.ExitCode != 0 {
+		buildErr := &BuildError{
+			Build:    build,
+			ExitCode: ret.ExitCode,
+			Stdout:   ret.Stdout,
+			Stderr:   ret.Stderr,
+		}
+		if buildErr.ExitCode < 0 || buildErr.ExitCode > 255 {
+			buildErr.ExitCode = 1
 		}
-		if err := receiveBuildResponse(stream, &item); err != nil {
-			return errors.Wrap(err, "failed to receive build response\n")
+		printBuildError(buildErr)
+		return buildErr
+	}
+
+	if err := checkBuildTargets(build); err != nil {
+		return errors.Wrap(err, "failed to check build targets\n")
+	}
+
+	return nil
+}
+
+// checkBuildTargets makes sure dependents only start once targets are in the workspace
+func checkBuildTargets(build *task.BuildInfo) error {
+	for _, item := range build.BuildTargets {
+		if _, err := os.Stat(filepath.Join(workSpacePath, item)); err != nil {
+			return errors.Wrap(err, "missing build target "+item+"\n")
 		}
 	}
 
 	return nil
 }
 
-func sendBuildRequest(stream grpc.BidiStreamingClient[proto.BuildRequest, proto.BuildReply], build *task.BuildInfo) error {
+// uploadBuildFiles uploads missing inputs and returns their digests, files
+// are sent inline as chunks to workers without an asset service
+func uploadBuildFiles(ctx context.Context, uploader *cas.Uploader, build *task.BuildInfo) ([]*proto.BuildFile, bool, error) {
 	var files []*proto.BuildFile
 
-	for _, item := range build.BuildFiles {
-		p := filepath.Join(workSpacePath, item)
-		sum, err := utils.Checksum(p)
-		if err != nil {
-			return errors.Wrap(err, "failed to calculate checksum\n")
+	inline := false
+
+	if err := uploader.Upload(ctx, build.BuildFiles); err != nil {
+		if !cas.IsUnimplemented(err) {
+			return nil, false, errors.Wrap(err, "failed to upload assets\n")
 		}
-		data, err := os.ReadFile(p)
+		inline = true
+	}
+
+	for _, item := range build.BuildFiles {
+		digest, err := uploader.Digest(item)
 		if err != nil {
-			return errors.Wrap(err, "failed to read file\n")
+			return nil, false, errors.Wrap(err, "failed to get digest\n")
 		}
 		file := &proto.BuildFile{
 			FilePath: item,
-			FileData: data,
-			CheckSum: sum,
+			CheckSum: digest.Hash,
+			Digest:   digest,
 		}
 		files = append(files, file)
 	}
 
+	return files, inline, nil
+}
+
+func sendBuildRequest(stream grpc.BidiStreamingClient[proto.BuildRequest, proto.BuildReply], build *task.BuildInfo, files []*proto.BuildFile, inline bool, key string) error {
 	id, err := createBuildID()
 	if err != nil {
 		return errors.Wrap(err, "failed to create build id\n")
 	}
 
+	m := task.NewPrefixMap(workSpacePath)
+
 	req := &proto.BuildRequest{
 		BuildID:      id,
 		BuildFiles:   files,
-		BuildRule:    build.BuildRule,
-		BuildPath:    workSpacePath,
+		BuildRule:    m.Apply(buildCommand(build)),
+		BuildPath:    task.WorkspacePlaceholder,
 		BuildTargets: build.BuildTargets,
+		ActionKey:    key,
 	}
 
 	if err := stream.Send(req); err != nil {
 		return errors.Wrap(err, "failed to send request\n")
 	}
 
+	if inline {
+		buf := make([]byte, chunkSize)
+		for _, item := range files {
+			if err := sendBuildChunks(stream, item.FilePath, buf); err != nil {
+				return errors.Wrap(err, "failed to send chunks\n")
+			}
+		}
+	}
+
 	if err := stream.CloseSend(); err != nil {
 		return errors.Wrap(err, "failed to close stream\n")
 	}
@@ -266,7 +1205,77 @@ func sendBuildRequest(stream grpc.BidiStreamingClient[proto.BuildRequest, proto.
 	return nil
 }
 
+func sendBuildChunks(stream grpc.BidiStreamingClient[proto.BuildRequest, proto.BuildReply], name string, buf []byte) error {
+	file, err := os.Open(filepath.Join(workSpacePath, name))
+	if err != nil {
+		return errors.Wrap(err, "failed to open file\n")
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var offset int64
+
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			req := &proto.BuildRequest{
+				BuildChunk: &proto.BuildChunk{
+					FilePath: name,
+					Offset:   offset,
+					Data:     buf[:n],
+				},
+			}
+			if err := stream.Send(req); err != nil {
+				return errors.Wrap(err, "failed to send request\n")
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file\n")
+		}
+	}
+
+	return nil
+}
+
+// receiveBuildResponse writes the targets a worker sends into the workspace and checks
+// each of them against the checksum of its header
 func receiveBuildResponse(stream grpc.BidiStreamingClient[proto.BuildRequest, proto.BuildReply], build *task.BuildInfo) error {
+	var stdout, stderr []byte
+
+	header, succeeded, exitCode := false, false, 0
+
+	m := task.NewPrefixMap(workSpacePath)
+
+	requested := map[string]bool{}
+	for _, item := range build.BuildTargets {
+		requested[filepath.Clean(item)] = true
+	}
+
+	// targetName maps a target path of the worker into the workspace, only requested targets are written
+	targetName := func(path string) (string, error) {
+		name := filepath.Clean(m.Rel(path))
+		if !filepath.IsLocal(name) || !requested[name] {
+			return "", errors.New("unexpected target " + path + "\n")
+		}
+		return name, nil
+	}
+
+	checksums := map[string]string{}
+
+	files := map[string]*os.File{}
+
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
 	for {
 		result, err := stream.Recv()
 		if err == io.EOF {
@@ -275,31 +1284,95 @@ func receiveBuildResponse(stream grpc.BidiStreamingClient[proto.BuildRequest, pr
 		if err != nil {
 			return errors.Wrap(err, "failed to receive response\n")
 		}
+		if !header {
+			header = true
+			succeeded, exitCode = result.GetBuildStatus(), int(result.GetExitCode())
+		}
+		stdout = append(stdout, result.GetStdout()...)
+		stderr = append(stderr, result.GetStderr()...)
 		for _, target := range result.GetBuildTargets() {
-			_path := filepath.Join(workSpacePath, target.TargetPath)
-			if _, err := os.Stat(_path); os.IsNotExist(err) {
-				if _, err := os.Stat(filepath.Dir(_path)); os.IsNotExist(err) {
-					if err := os.MkdirAll(filepath.Dir(_path), os.ModePerm); err != nil {
-						return errors.Wrap(err, "failed to make directory\n")
-					}
-				}
+			name, err := targetName(target.GetTargetPath())
+			if err != nil {
+				return err
+			}
+			file, err := createTarget(name)
+			if err != nil {
+				return errors.Wrap(err, "failed to create target\n")
 			}
-			if err := os.WriteFile(_path, target.GetTargetData(), 0755); err != nil {
+			if _, err := file.Write(target.GetTargetData()); err != nil {
+				_ = file.Close()
 				return errors.Wrap(err, "failed to write file\n")
 			}
-			sum, err := utils.Checksum(_path)
+			if err := file.Close(); err != nil {
+				return errors.Wrap(err, "failed to close file\n")
+			}
+			checksums[name] = target.GetChecksum()
+		}
+		if chunk := result.GetTargetChunk(); chunk != nil {
+			name, err := targetName(chunk.GetFilePath())
 			if err != nil {
-				return errors.Wrap(err, "failed to calculate checksum\n")
+				return err
 			}
-			if sum != target.GetChecksum() {
-				return errors.New("checksum mismatch\n")
+			if _, ok := checksums[name]; !ok {
+				return errors.New("chunk of " + name + " before its header\n")
 			}
+			file, ok := files[name]
+			if !ok {
+				file, err = createTarget(name)
+				if err != nil {
+					return errors.Wrap(err, "failed to create target\n")
+				}
+				files[name] = file
+			}
+			if _, err := file.WriteAt(chunk.GetData(), chunk.GetOffset()); err != nil {
+				return errors.Wrap(err, "failed to write file\n")
+			}
+		}
+	}
+
+	if !succeeded || exitCode != 0 {
+		if exitCode <= 0 || exitCode > 255 {
+			exitCode = 1
+		}
+		return &BuildError{
+			Build:    build,
+			ExitCode: exitCode,
+			Stdout:   []byte(m.Revert(string(stdout))),
+			Stderr:   []byte(m.Revert(string(stderr))),
+		}
+	}
+
+	for name, file := range files {
+		delete(files, name)
+		if err := file.Close(); err != nil {
+			return errors.Wrap(err, "failed to close file\n")
+		}
+	}
+
+	for name, checksum := range checksums {
+		sum, err := utils.Checksum(filepath.Join(workSpacePath, name))
+		if err != nil {
+			return errors.Wrap(err, "failed to calculate checksum\n")
+		}
+		if sum != checksum {
+			return errors.New("checksum mismatch of " + name + "\n")
 		}
 	}
 
 	return nil
 }
 
+// createTarget truncates the target file, creating its directory if needed
+func createTarget(name string) (*os.File, error) {
+	_path := filepath.Join(workSpacePath, name)
+
+	if err := os.MkdirAll(filepath.Dir(_path), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "failed to make directory\n")
+	}
+
+	return os.OpenFile(_path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+}
+
 func createBuildID() (string, error) {
 	var address string
 
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"distbuild/boong/proxy/cas"
+	"distbuild/boong/proxy/proto"
+	"distbuild/boong/proxy/task"
 )
 
 func TestCreateBuildID(t *testing.T) {
@@ -23,3 +39,401 @@ func TestGetTargetPath(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, request[0], _path)
 }
+
+type fakeBuildStream struct {
+	grpc.ClientStream
+	replies  []*proto.BuildReply
+	requests []*proto.BuildRequest
+}
+
+func (s *fakeBuildStream) Send(req *proto.BuildRequest) error {
+	s.requests = append(s.requests, req)
+	return nil
+}
+
+func (s *fakeBuildStream) Recv() (*proto.BuildReply, error) {
+	if len(s.replies) == 0 {
+		return nil, io.EOF
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	return reply, nil
+}
+
+func (s *fakeBuildStream) CloseSend() error {
+	return nil
+}
+
+// fakeAssets serves one action result and the blobs of its outputs, or fails with err
+type fakeAssets struct {
+	proto.AssetServiceClient
+	result *proto.ActionResult
+	blobs  map[string][]byte
+	err    error
+}
+
+func (a *fakeAssets) GetActionResult(_ context.Context, _ *proto.GetActionResultRequest, _ ...grpc.CallOption) (*proto.ActionResult, error) {
+	return a.result, a.err
+}
+
+func (a *fakeAssets) Download(_ context.Context, req *proto.DownloadRequest, _ ...grpc.CallOption) (grpc.ServerStreamingClient[proto.DownloadReply], error) {
+	return &fakeDownload{data: a.blobs[req.GetDigest().GetHash()]}, nil
+}
+
+type fakeDownload struct {
+	grpc.ClientStream
+	data []byte
+	done bool
+}
+
+func (d *fakeDownload) Recv() (*proto.DownloadReply, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	d.done = true
+	return &proto.DownloadReply{Data: d.data}, nil
+}
+
+func TestCached(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	ctx := context.Background()
+	build := &task.BuildInfo{BuildTargets: []string{"out/a.o"}}
+
+	sum := sha256.Sum256([]byte("a"))
+	hash := hex.EncodeToString(sum[:])
+
+	assets := &fakeAssets{
+		result: &proto.ActionResult{OutputFiles: []*proto.OutputFile{{FilePath: "out/a.o", Digest: &proto.Digest{Hash: hash, Size: 1}}}},
+		blobs:  map[string][]byte{hash: []byte("a")},
+	}
+
+	w := &remoteWorker{assets: assets}
+
+	hit, err := w.cached(ctx, "key", build)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, hit)
+
+	// a corrupt entry is a miss, and leaves no partial output behind
+	assets.blobs[hash] = []byte("b")
+
+	hit, err = w.cached(ctx, "key", build)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, hit)
+
+	_, err = os.Stat(filepath.Join(workSpacePath, "out", "a.o"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// a cache the worker cannot read is a miss, only transport errors are retried
+	assets.err = status.Error(codes.PermissionDenied, "denied")
+
+	hit, err = w.cached(ctx, "key", build)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, hit)
+
+	assets.err = status.Error(codes.Unavailable, "unavailable")
+
+	_, err = w.cached(ctx, "key", build)
+	assert.Equal(t, true, isTransportError(err))
+
+	assets.err = status.Error(codes.Unimplemented, "unimplemented")
+
+	hit, err = w.cached(ctx, "key", build)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, hit)
+	assert.Equal(t, true, w.noActionCache.Load())
+}
+
+func TestReceiveBuildResponse(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	data := []byte("0123456789")
+	sum := sha256.Sum256(data)
+
+	stream := &fakeBuildStream{
+		replies: []*proto.BuildReply{
+			{BuildStatus: true, BuildTargets: []*proto.BuildTarget{{TargetPath: "out/a.o", Checksum: hex.EncodeToString(sum[:])}}},
+			{TargetChunk: &proto.BuildChunk{FilePath: "out/a.o", Offset: 0, Data: data[:4]}},
+			{TargetChunk: &proto.BuildChunk{FilePath: "out/a.o", Offset: 4, Data: data[4:]}},
+		},
+	}
+
+	err := receiveBuildResponse(stream, &task.BuildInfo{BuildTargets: []string{"out/a.o"}})
+	assert.Equal(t, nil, err)
+
+	buf, err := os.ReadFile(filepath.Join(workSpacePath, "out", "a.o"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestReceiveBuildTargets(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	data := []byte("0123456789")
+	sum := sha256.Sum256(data)
+
+	build := &task.BuildInfo{BuildTargets: []string{"out/a.o"}}
+
+	tests := map[string][]*proto.BuildReply{
+		// chunks need a header carrying their checksum
+		"no header": {
+			{BuildStatus: true},
+			{TargetChunk: &proto.BuildChunk{FilePath: "out/a.o", Data: data}},
+		},
+		"checksum": {
+			{BuildStatus: true, BuildTargets: []*proto.BuildTarget{{TargetPath: "out/a.o", Checksum: hex.EncodeToString(sum[:])}}},
+			{TargetChunk: &proto.BuildChunk{FilePath: "out/a.o", Data: data[1:]}},
+		},
+		"outside": {
+			{BuildStatus: true, BuildTargets: []*proto.BuildTarget{{TargetPath: "../../x", Checksum: hex.EncodeToString(sum[:])}}},
+		},
+		"not requested": {
+			{BuildStatus: true, BuildTargets: []*proto.BuildTarget{{TargetPath: "out/b.o", Checksum: hex.EncodeToString(sum[:])}}},
+		},
+	}
+
+	for name, replies := range tests {
+		err := receiveBuildResponse(&fakeBuildStream{replies: replies}, build)
+		assert.NotEqual(t, nil, err, name)
+	}
+
+	_, err := os.Stat(filepath.Join(workSpacePath, "out", "b.o"))
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestSendBuildChunks(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	data := bytes.Repeat([]byte("x"), 10)
+	_ = os.WriteFile(filepath.Join(workSpacePath, "a.c"), data, os.ModePerm)
+
+	stream := &fakeBuildStream{}
+
+	err := sendBuildChunks(stream, "a.c", make([]byte, 4))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(stream.requests))
+	assert.Equal(t, int64(8), stream.requests[2].GetBuildChunk().GetOffset())
+}
+
+func TestReceiveBuildFailure(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	stream := &fakeBuildStream{
+		replies: []*proto.BuildReply{
+			{BuildStatus: false, ExitCode: 2, Stderr: []byte("error: a.c")},
+			{Stderr: []byte(": expected ';'\n")},
+		},
+	}
+
+	build := &task.BuildInfo{BuildRule: "clang -c a.c -o out/a.o", BuildTargets: []string{"out/a.o"}}
+
+	err := receiveBuildResponse(stream, build)
+
+	var buildErr *BuildError
+	assert.Equal(t, true, errors.As(err, &buildErr))
+	assert.Equal(t, 2, buildErr.ExitCode)
+	assert.Equal(t, "error: a.c: expected ';'\n", string(buildErr.Stderr))
+	assert.Equal(t, "build out/a.o failed with exit code 2", err.Error())
+}
+
+func TestIsTransportError(t *testing.T) {
+	err := errors.Wrap(status.Error(codes.Unavailable, "connection refused"), "failed to send client build\n")
+	assert.Equal(t, true, isTransportError(err))
+
+	err = errors.Wrap(&BuildError{Build: &task.BuildInfo{}, ExitCode: 1}, "failed to receive build response\n")
+	assert.Equal(t, false, isTransportError(err))
+
+	assert.Equal(t, false, isTransportError(errors.New("checksum mismatch\n")))
+}
+
+func TestActionKey(t *testing.T) {
+	var keys []string
+
+	for _, dir := range []string{t.TempDir(), t.TempDir()} {
+		workSpacePath = dir
+		_ = os.WriteFile(filepath.Join(dir, "a.c"), []byte("int a;"), os.ModePerm)
+		build := &task.BuildInfo{
+			BuildRule:    "clang -c " + filepath.Join(dir, "a.c") + " -o out/a.o",
+			BuildFiles:   []string{"a.c"},
+			BuildTargets: []string{"out/a.o"},
+		}
+		key, err := actionKey(cas.NewDigester(dir), build)
+		assert.Equal(t, nil, err)
+		keys = append(keys, key)
+	}
+
+	assert.Equal(t, keys[0], keys[1])
+
+	// the same normalized rule written for another prebuilt compiler is another action
+	build := &task.BuildInfo{
+		BuildRule:    "clang -c a.c -o out/a.o",
+		BuildFiles:   []string{"a.c"},
+		BuildTargets: []string{"out/a.o"},
+		Toolchain:    "prebuilts/clang/host/linux-x86/clang-r1/bin/clang",
+	}
+
+	key, err := actionKey(cas.NewDigester(workSpacePath), build)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, keys[1], key)
+
+	build.Toolchain = "prebuilts/clang/host/linux-x86/clang-r2/bin/clang"
+
+	next, err := actionKey(cas.NewDigester(workSpacePath), build)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, key, next)
+}
+
+func TestReceiveBuildPlaceholder(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	sum := sha256.Sum256([]byte("a"))
+
+	stream := &fakeBuildStream{
+		replies: []*proto.BuildReply{
+			{BuildStatus: true, BuildTargets: []*proto.BuildTarget{{TargetPath: "/proc/self/cwd/out/a.o", TargetData: []byte("a"), Checksum: hex.EncodeToString(sum[:])}}},
+		},
+	}
+
+	err := receiveBuildResponse(stream, &task.BuildInfo{BuildTargets: []string{"out/a.o"}})
+	assert.Equal(t, nil, err)
+
+	buf, err := os.ReadFile(filepath.Join(workSpacePath, "out", "a.o"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("a"), buf)
+
+	stream = &fakeBuildStream{
+		replies: []*proto.BuildReply{
+			{BuildStatus: false, ExitCode: 1, Stderr: []byte("/proc/self/cwd/a.c:1: error")},
+		},
+	}
+
+	err = receiveBuildResponse(stream, &task.BuildInfo{BuildTargets: []string{"out/a.o"}})
+
+	var buildErr *BuildError
+	assert.Equal(t, true, errors.As(err, &buildErr))
+	assert.Equal(t, filepath.ToSlash(workSpacePath)+"/a.c:1: error", string(buildErr.Stderr))
+}
+
+func TestBuildCommand(t *testing.T) {
+	build := &task.BuildInfo{BuildRule: "cc -c a.c"}
+	assert.Equal(t, "cc -c a.c", buildCommand(build))
+
+	build.BuildPath = "out"
+	assert.Equal(t, "cd out && cc -c a.c", buildCommand(build))
+
+	build.BuildPath = "build dir"
+	assert.Equal(t, "cd 'build dir' && cc -c a.c", buildCommand(build))
+}
+
+func TestDetectFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := map[string]string{
+		"build.ninja":           formatNinja,
+		"compile_commands.json": formatCompdb,
+		"compile_info.json":     formatSoong,
+		"rules.txt":             formatNinja,
+	}
+
+	data := map[string]string{
+		"build.ninja":           "[",
+		"compile_commands.json": "\n  [{}]",
+		"compile_info.json":     `{"commands": []}`,
+		"rules.txt":             "rule cc\n",
+	}
+
+	for name, format := range tests {
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, []byte(data[name]), 0644)
+		assert.Equal(t, nil, err)
+		ret, err := detectFormat(p)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, format, ret, name)
+	}
+}
+
+func TestNewTaskSource(t *testing.T) {
+	workSpacePath = t.TempDir()
+	taskFormat = formatAuto
+
+	err := os.WriteFile(filepath.Join(workSpacePath, "a.c"), []byte("int a;\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	// a compile file given by absolute path, outside of the out directory
+	compileFile = filepath.Join(t.TempDir(), "compile.json")
+
+	data := `{"commands": [{"command": "clang -c a.c -o a.o", "compilerType": "clang", "inputFiles": ["a.c"], "outputFile": "a.o"}]}`
+	err = os.WriteFile(compileFile, []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	source, err := newTaskSource(context.Background())
+	assert.Equal(t, nil, err)
+
+	tasks, err := source.Load(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, []string{"a.c"}, tasks[0].BuildFiles)
+
+	report, err := lintCompileFile()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, compileFile, report.File)
+	assert.Equal(t, 0, len(report.Issues))
+}
+
+func TestRecordDeps(t *testing.T) {
+	workSpacePath = t.TempDir()
+
+	for _, item := range []string{"src/a.c", "include/a.h", "out/a.d"} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(workSpacePath, item)), os.ModePerm)
+		assert.Equal(t, nil, err)
+		err = os.WriteFile(filepath.Join(workSpacePath, item), nil, 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	data := "a.o: ../src/a.c " + task.WorkspacePlaceholder + "/include/a.h /usr/include/stdio.h\n"
+	err := os.WriteFile(filepath.Join(workSpacePath, "out", "a.d"), []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	build := &task.BuildInfo{
+		BuildRule:    "cc -MD -c ../src/a.c -o a.o",
+		BuildTargets: []string{filepath.Join("out", "a.o"), filepath.Join("out", "a.d")},
+		BuildPath:    "out",
+		Depfile:      filepath.Join("out", "a.d"),
+	}
+
+	deps, err := task.OpenDepDB(workSpacePath)
+	assert.Equal(t, nil, err)
+
+	err = recordDeps(deps, build)
+	assert.Equal(t, nil, err)
+
+	inputs, ok := deps.Lookup(workSpacePath, build.BuildTargets[0], build.BuildRule)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, []string{filepath.Join("src", "a.c"), filepath.Join("include", "a.h")}, inputs)
+}
+
+func TestPrintLint(t *testing.T) {
+	report := &task.LintReport{
+		File:     "out/compile.json",
+		Commands: 2,
+		Issues: []task.Issue{
+			{Index: 1, Offset: 42, Kind: task.IssueEmptyOutput, Message: "output file is empty, the command has no target"},
+		},
+	}
+
+	var buf bytes.Buffer
+
+	err := printLint(&buf, report, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "out/compile.json: command 1 at offset 42: empty-output: output file is empty, the command has no target\n2 commands, 1 issues\n", buf.String())
+
+	buf.Reset()
+
+	err = printLint(&buf, report, true)
+	assert.Equal(t, nil, err)
+
+	var ret task.LintReport
+	err = json.Unmarshal(buf.Bytes(), &ret)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, *report, ret)
+}
@@ -0,0 +1,276 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CompileCommand is one entry of a clang compile_commands.json
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments"`
+	Command   string   `json:"command"`
+	File      string   `json:"file"`
+	Output    string   `json:"output"`
+}
+
+type compdbSource struct {
+	path     string
+	filename string
+	opts     *Options
+}
+
+// NewCompdbSource reads the compilation database filename of the workspace path
+func NewCompdbSource(path, filename string, opts *Options) Source {
+	return &compdbSource{
+		path:     path,
+		filename: filename,
+		opts:     opts,
+	}
+}
+
+func (s *compdbSource) Load(_ context.Context) ([]BuildInfo, error) {
+	log.Printf("Compile database: %s\n", s.filename)
+
+	data, err := os.ReadFile(s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compile database: %v", err)
+	}
+
+	var commands []CompileCommand
+
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %v", err)
+	}
+
+	root, err := filepath.Abs(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace path: %v", err)
+	}
+
+	base, err := filepath.Abs(filepath.Dir(s.filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compile database path: %v", err)
+	}
+
+	var tasks []BuildInfo
+
+	ignore, err := LoadIgnore(root, s.opts.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load exclusion rules: %v", err)
+	}
+
+	cache := newIncludeCache(ignore)
+
+	db, err := OpenDepDB(root)
+	if err != nil {
+		log.Printf("failed to open dependency database: %v\n", err)
+	}
+
+	for i, command := range commands {
+		task, err := compileTask(db, cache, root, base, command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command %d: %v", i, err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+// compileTask maps a compile command onto a task relative to the workspace root
+func compileTask(db *DepDB, cache *includeCache, root, base string, command CompileCommand) (BuildInfo, error) {
+	var task BuildInfo
+
+	dir := command.Directory
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+
+	buildPath, err := workspaceRel(root, dir, ".")
+	if err != nil {
+		return task, err
+	}
+
+	if buildPath != "." {
+		task.BuildPath = buildPath
+	}
+
+	args := command.Arguments
+	task.BuildRule = command.Command
+
+	if len(args) == 0 {
+		args = splitCommand(command.Command)
+	} else if task.BuildRule == "" {
+		task.BuildRule = joinCommand(args)
+	}
+
+	if task.BuildRule == "" {
+		return task, fmt.Errorf("missing command")
+	}
+
+	file, err := workspaceRel(root, dir, command.File)
+	if err != nil {
+		return task, err
+	}
+
+	task.BuildFiles = append(task.BuildFiles, file)
+
+	output := command.Output
+	if output == "" {
+		output = argValue(args, "-o")
+	}
+
+	if output != "" {
+		target, err := workspaceRel(root, dir, output)
+		if err != nil {
+			return task, err
+		}
+		task.BuildTargets = append(task.BuildTargets, target)
+	}
+
+	var includes []string
+
+	for _, item := range includeDirs(args) {
+		// include directories outside the workspace are expected on the worker
+		if include, err := workspaceRel(root, dir, item); err == nil {
+			includes = append(includes, include)
+		}
+	}
+
+	if depfile := depfileArg(args); depfile != "" && len(task.BuildTargets) > 0 {
+		if task.Depfile, err = workspaceRel(root, dir, depfile); err != nil {
+			return task, err
+		}
+		task.BuildTargets = append(task.BuildTargets, task.Depfile)
+	}
+
+	if len(task.BuildTargets) > 0 {
+		if inputs, ok := db.Lookup(root, task.BuildTargets[0], task.BuildRule); ok {
+			cache.ignore.Merge(root, &task, inputs)
+			return task, nil
+		}
+	}
+
+	var stats excluded
+
+	task.BuildFiles, stats, err = includeFiles(cache, root, dir, task.BuildFiles, args, includes)
+	if err != nil {
+		return task, fmt.Errorf("failed to append include path: %v", err)
+	}
+
+	stats.log(task)
+
+	return task, nil
+}
+
+// workspaceRel resolves name against dir and makes it relative to root
+func workspaceRel(root, dir, name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+
+	rel, err := filepath.Rel(root, filepath.Clean(name))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the workspace", name)
+	}
+
+	return rel, nil
+}
+
+// argValue returns the value of flag given either as "-o value" or "-ovalue"
+func argValue(args []string, flag string) string {
+	for i, item := range args {
+		if item == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(item, flag) && len(item) > len(flag) {
+			return item[len(flag):]
+		}
+	}
+
+	return ""
+}
+
+func includeDirs(args []string) []string {
+	var dirs []string
+
+	for i := 0; i < len(args); i++ {
+		for _, flag := range []string{"-I", "-isystem", "-iquote"} {
+			if args[i] == flag && i+1 < len(args) {
+				dirs = append(dirs, args[i+1])
+				i++
+				break
+			}
+			if strings.HasPrefix(args[i], flag) && len(args[i]) > len(flag) {
+				dirs = append(dirs, args[i][len(flag):])
+				break
+			}
+		}
+	}
+
+	return dirs
+}
+
+// splitCommand splits a shell command line into arguments, honoring quotes and backslashes
+func splitCommand(command string) []string {
+	var args []string
+	var buf strings.Builder
+
+	quote := rune(0)
+	escaped := false
+	started := false
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			buf.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			started = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				buf.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			started = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if started {
+				args = append(args, buf.String())
+				buf.Reset()
+				started = false
+			}
+		default:
+			buf.WriteRune(c)
+			started = true
+		}
+	}
+
+	if started {
+		args = append(args, buf.String())
+	}
+
+	return args
+}
+
+func joinCommand(args []string) string {
+	var buf []string
+
+	for _, item := range args {
+		if item == "" || strings.ContainsAny(item, " \t\n'\"\\$`&|;<>()*?[]#~") {
+			item = "'" + strings.ReplaceAll(item, "'", `'\''`) + "'"
+		}
+		buf = append(buf, item)
+	}
+
+	return strings.Join(buf, " ")
+}
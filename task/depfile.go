@@ -0,0 +1,254 @@
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// DepsName is the dependency database under the out directory of the workspace
+	DepsName = ".boong_deps"
+)
+
+// DepDB records the exact inputs of outputs, as reported by depfiles of previous builds
+type DepDB struct {
+	name    string
+	mutex   sync.Mutex
+	entries map[string]*depEntry
+	dirty   bool
+}
+
+type depEntry struct {
+	Command string     `json:"command"`
+	Inputs  []depInput `json:"inputs"`
+}
+
+type depInput struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// ParseDepfile parses a Makefile-syntax depfile into the targets of its
+// first rule and the inputs of all rules
+func ParseDepfile(data []byte) ([]string, []string, error) {
+	var targets, inputs []string
+	var buf []byte
+
+	seen := map[string]bool{}
+	rule := 0
+	inTargets := true
+	tokens := 0
+
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		name := string(buf)
+		buf = buf[:0]
+		tokens++
+		if inTargets {
+			if rule == 0 {
+				targets = append(targets, name)
+			}
+			return
+		}
+		if !seen[name] {
+			seen[name] = true
+			inputs = append(inputs, name)
+		}
+	}
+
+	space := func(i int) bool {
+		return i >= len(data) || data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r'
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data) && data[i+1] == '\n':
+			flush()
+			i++
+		case c == '\\' && i+2 < len(data) && data[i+1] == '\r' && data[i+2] == '\n':
+			flush()
+			i += 2
+		case c == '\\' && i+1 < len(data) && (data[i+1] == ' ' || data[i+1] == '#' || data[i+1] == ':'):
+			buf = append(buf, data[i+1])
+			i++
+		case c == '$' && i+1 < len(data) && data[i+1] == '$':
+			buf = append(buf, '$')
+			i++
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '\n' || c == '\r':
+			flush()
+			if inTargets && tokens > 0 {
+				return nil, nil, fmt.Errorf("expected ':' in rule %d", rule+1)
+			}
+			if tokens > 0 {
+				rule++
+			}
+			inTargets = true
+			tokens = 0
+		case c == ':' && inTargets && space(i+1):
+			flush()
+			inTargets = false
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	flush()
+
+	if inTargets && tokens > 0 {
+		return nil, nil, fmt.Errorf("expected ':' in rule %d", rule+1)
+	}
+
+	return targets, inputs, nil
+}
+
+// depfileArg returns the depfile a compiler command writes, from -MF or
+// next to the -o output for -MD and -MMD
+func depfileArg(args []string) string {
+	if name := argValue(args, "-MF"); name != "" {
+		return name
+	}
+
+	for _, item := range args {
+		if item == "-MD" || item == "-MMD" {
+			if output := argValue(args, "-o"); output != "" {
+				return strings.TrimSuffix(output, filepath.Ext(output)) + ".d"
+			}
+		}
+	}
+
+	return ""
+}
+
+// OpenDepDB loads the dependency database of the workspace root, an absent one is empty
+func OpenDepDB(root string) (*DepDB, error) {
+	d := &DepDB{
+		name:    filepath.Join(root, "out", DepsName),
+		entries: map[string]*depEntry{},
+	}
+
+	data, err := os.ReadFile(d.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", d.name, err)
+	}
+
+	if err := json.Unmarshal(data, &d.entries); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", d.name, err)
+	}
+
+	return d, nil
+}
+
+// Lookup returns the recorded inputs of target, if it was built by the same
+// command and none of its inputs changed since
+func (d *DepDB) Lookup(root, target, command string) ([]string, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	d.mutex.Lock()
+	entry, ok := d.entries[filepath.ToSlash(target)]
+	d.mutex.Unlock()
+
+	if !ok || entry.Command != commandHash(command) {
+		return nil, false
+	}
+
+	var buf []string
+
+	for _, item := range entry.Inputs {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(item.Path)))
+		if err != nil || info.Size() != item.Size || info.ModTime().UnixNano() != item.ModTime {
+			return nil, false
+		}
+		buf = append(buf, filepath.FromSlash(item.Path))
+	}
+
+	return buf, true
+}
+
+// Record stores the workspace relative inputs target was built from
+func (d *DepDB) Record(root, target, command string, inputs []string) error {
+	if d == nil {
+		return nil
+	}
+
+	entry := &depEntry{
+		Command: commandHash(command),
+	}
+
+	for _, item := range inputs {
+		info, err := os.Stat(filepath.Join(root, item))
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", item, err)
+		}
+		entry.Inputs = append(entry.Inputs, depInput{
+			Path:    filepath.ToSlash(item),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	d.mutex.Lock()
+	d.entries[filepath.ToSlash(target)] = entry
+	d.dirty = true
+	d.mutex.Unlock()
+
+	return nil
+}
+
+// Save writes the database back if anything was recorded
+func (d *DepDB) Save() error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(d.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode deps: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.name), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to make directory: %v", err)
+	}
+
+	tmp := d.name + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+
+	if err := os.Rename(tmp, d.name); err != nil {
+		return fmt.Errorf("failed to rename %s: %v", tmp, err)
+	}
+
+	d.dirty = false
+
+	return nil
+}
+
+func commandHash(command string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(command), " ")))
+	return hex.EncodeToString(sum[:])
+}
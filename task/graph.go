@@ -0,0 +1,175 @@
+package task
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+type Node struct {
+	Task       BuildInfo
+	Deps       []int
+	Dependents []int
+}
+
+type Graph struct {
+	Nodes     []Node
+	producers map[string]int
+	consumed  map[string]bool
+}
+
+// NewGraph links every task to the tasks producing its build files
+func NewGraph(tasks []BuildInfo) (*Graph, error) {
+	g := &Graph{
+		Nodes:     make([]Node, len(tasks)),
+		producers: map[string]int{},
+		consumed:  map[string]bool{},
+	}
+
+	producers := g.producers
+
+	for i, item := range tasks {
+		g.Nodes[i].Task = item
+		for _, target := range item.BuildTargets {
+			target = filepath.Clean(target)
+			if j, ok := producers[target]; ok {
+				return nil, fmt.Errorf("output %s produced by both %s and %s", target, g.Label(j), g.Label(i))
+			}
+			producers[target] = i
+		}
+	}
+
+	for i, item := range tasks {
+		seen := map[int]bool{}
+		for _, file := range item.BuildFiles {
+			file = filepath.Clean(file)
+			g.consumed[file] = true
+			j, ok := producers[file]
+			if !ok || j == i || seen[j] {
+				continue
+			}
+			seen[j] = true
+			g.Nodes[i].Deps = append(g.Nodes[i].Deps, j)
+			g.Nodes[j].Dependents = append(g.Nodes[j].Dependents, i)
+		}
+	}
+
+	if err := g.checkCycle(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Add appends a task streamed after the tasks producing its build files,
+// a task producing a file an earlier task consumes is rejected
+func (g *Graph) Add(t BuildInfo) (int, error) {
+	if g.producers == nil {
+		g.producers = map[string]int{}
+		g.consumed = map[string]bool{}
+	}
+
+	i := len(g.Nodes)
+
+	for _, target := range t.BuildTargets {
+		target = filepath.Clean(target)
+		if j, ok := g.producers[target]; ok {
+			return -1, fmt.Errorf("output %s produced by both %s and %s", target, g.Label(j), Label(t))
+		}
+		if g.consumed[target] {
+			return -1, fmt.Errorf("output %s of %s is consumed by an earlier task", target, Label(t))
+		}
+	}
+
+	node := Node{Task: t}
+	seen := map[int]bool{}
+
+	for _, file := range t.BuildFiles {
+		file = filepath.Clean(file)
+		g.consumed[file] = true
+		j, ok := g.producers[file]
+		if !ok || seen[j] {
+			continue
+		}
+		seen[j] = true
+		node.Deps = append(node.Deps, j)
+		g.Nodes[j].Dependents = append(g.Nodes[j].Dependents, i)
+	}
+
+	for _, target := range t.BuildTargets {
+		g.producers[filepath.Clean(target)] = i
+	}
+
+	g.Nodes = append(g.Nodes, node)
+
+	return i, nil
+}
+
+// Produces reports whether a node of the graph produces file
+func (g *Graph) Produces(file string) bool {
+	_, ok := g.producers[filepath.Clean(file)]
+	return ok
+}
+
+// Label names a node by its first target, or by its rule if it has none
+func (g *Graph) Label(i int) string {
+	return Label(g.Nodes[i].Task)
+}
+
+// Label names a task by its first target, or by its rule when it has none
+func Label(t BuildInfo) string {
+	if len(t.BuildTargets) > 0 {
+		return t.BuildTargets[0]
+	}
+	return t.BuildRule
+}
+
+func (g *Graph) checkCycle() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(g.Nodes))
+
+	var stack []int
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, dep := range g.Nodes[i].Deps {
+			switch state[dep] {
+			case visiting:
+				var names []string
+				start := len(stack) - 1
+				for stack[start] != dep {
+					start--
+				}
+				for _, item := range stack[start:] {
+					names = append(names, g.Label(item))
+				}
+				names = append(names, g.Label(dep))
+				return fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+			case unvisited:
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.Nodes {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// IgnoreName is the file of gitignore-style exclusion rules in the workspace root
+	IgnoreName = ".distignore"
+)
+
+// Options tunes how tasks are derived from a compile file
+type Options struct {
+	// Exclude holds extra gitignore-style patterns on top of .distignore
+	Exclude []string
+}
+
+// Ignore matches workspace relative paths against gitignore-style rules
+type Ignore struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ParseIgnore compiles gitignore-style patterns, later rules taking precedence
+func ParseIgnore(patterns []string) *Ignore {
+	g := &Ignore{}
+
+	for _, item := range patterns {
+		item = strings.TrimRight(item, " \t\r")
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+
+		if strings.HasPrefix(item, "!") {
+			rule.negate = true
+			item = item[1:]
+		} else if strings.HasPrefix(item, `\!`) || strings.HasPrefix(item, `\#`) {
+			item = item[1:]
+		}
+
+		if strings.HasSuffix(item, "/") {
+			rule.dirOnly = true
+			item = strings.TrimRight(item, "/")
+		}
+
+		// a pattern with a separator other than a trailing one is relative to the root
+		if strings.Contains(item, "/") {
+			rule.anchored = true
+			item = strings.TrimPrefix(item, "/")
+		}
+
+		if item == "" {
+			continue
+		}
+
+		rule.segments = strings.Split(item, "/")
+		g.rules = append(g.rules, rule)
+	}
+
+	return g
+}
+
+// LoadIgnore reads the .distignore of root, an absent one has no rules, and adds exclude
+func LoadIgnore(root string, exclude []string) (*Ignore, error) {
+	var patterns []string
+
+	file, err := os.Open(filepath.Join(root, IgnoreName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open %s: %v", IgnoreName, err)
+	}
+
+	if err == nil {
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			patterns = append(patterns, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", IgnoreName, err)
+		}
+	}
+
+	patterns = append(patterns, exclude...)
+
+	return ParseIgnore(patterns), nil
+}
+
+// Match reports whether name, relative to the workspace root, is excluded
+// itself or by one of its parent directories
+func (g *Ignore) Match(name string, isDir bool) bool {
+	if g == nil || len(g.rules) == 0 {
+		return false
+	}
+
+	segments := strings.Split(filepath.ToSlash(filepath.Clean(name)), "/")
+
+	for i := 1; i < len(segments); i++ {
+		if g.match(segments[:i], true) {
+			return true
+		}
+	}
+
+	return g.match(segments, isDir)
+}
+
+// Merge adds the files of extra not yet among the build files of t, such as headers
+// recorded by a previous build, leaving out those g matches, and logs how many it left
+// out along with their size. The build files t already has are always kept
+func (g *Ignore) Merge(root string, t *BuildInfo, extra []string) {
+	var stats excluded
+
+	t.BuildFiles = g.merge(root, t.BuildFiles, extra, &stats)
+
+	stats.log(*t)
+}
+
+// merge adds the files of extra not in files and not matched by g, counting the matched ones
+func (g *Ignore) merge(root string, files, extra []string, stats *excluded) []string {
+	if g == nil || len(g.rules) == 0 {
+		return mergeFiles(files, extra)
+	}
+
+	seen := map[string]bool{}
+	for _, item := range files {
+		seen[item] = true
+	}
+
+	var buf []string
+
+	for _, item := range extra {
+		if seen[item] {
+			continue
+		}
+		if !g.Match(item, false) {
+			buf = append(buf, item)
+			continue
+		}
+		seen[item] = true
+		stats.files++
+		if info, err := os.Stat(filepath.Join(root, item)); err == nil {
+			stats.bytes += info.Size()
+		}
+	}
+
+	return mergeFiles(files, buf)
+}
+
+func (g *Ignore) match(segments []string, isDir bool) bool {
+	ret := false
+
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.matches(segments) {
+			ret = !rule.negate
+		}
+	}
+
+	return ret
+}
+
+func (r *ignoreRule) matches(segments []string) bool {
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], segments[len(segments)-1])
+		return ok
+	}
+
+	return matchSegments(r.segments, segments)
+}
+
+// matchSegments matches path segments against pattern segments, where ** spans any number of them
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,368 @@
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	includePattern = regexp.MustCompile(`^\s*#\s*(include|include_next|import)\b\s*(.*)$`)
+	sourceExts     = []string{".c", ".cc", ".cpp", ".cxx", ".c++", ".m", ".mm", ".s", ".h", ".hh", ".hpp", ".hxx", ".inc", ".ipp"}
+)
+
+// directive is one #include of a file, quoted or angled
+type directive struct {
+	name   string
+	quoted bool
+	next   bool
+}
+
+// includeCache memoizes the directives of every scanned file, and the
+// include directories shipped whole when scanning fails
+type includeCache struct {
+	mutex      sync.Mutex
+	directives map[string][]directive
+	errs       map[string]error
+	index      *dirIndex
+	ignore     *Ignore
+}
+
+// includeScanner collects the headers sources include transitively
+type includeScanner struct {
+	root   string
+	dir    string
+	cache  *includeCache
+	quote  []string
+	search []string
+	seen   map[string]bool
+	files  []string
+}
+
+func newIncludeCache(ignore *Ignore) *includeCache {
+	return &includeCache{
+		directives: map[string][]directive{},
+		errs:       map[string]error{},
+		index:      newDirIndex(ignore),
+		ignore:     ignore,
+	}
+}
+
+// scanIncludes returns the workspace relative headers the sources of a command
+// include, along with the -include and -imacros headers of args, searching -iquote,
+// -I and -isystem paths of args, then includes and then -idirafter paths of args.
+// An error means the set could not be resolved and include directories should be shipped
+func scanIncludes(cache *includeCache, root, dir string, sources, args, includes []string) ([]string, error) {
+	s := &includeScanner{
+		root:  root,
+		dir:   dir,
+		cache: cache,
+		seen:  map[string]bool{},
+	}
+
+	var after, forced []string
+
+	for i := 0; i < len(args); i++ {
+		for _, flag := range []string{"-iquote", "-isystem", "-idirafter", "-include", "-imacros", "-I"} {
+			value := ""
+			if args[i] == flag && i+1 < len(args) {
+				value = args[i+1]
+				i++
+			} else if strings.HasPrefix(args[i], flag) && len(args[i]) > len(flag) {
+				value = args[i][len(flag):]
+			} else {
+				continue
+			}
+			switch flag {
+			case "-iquote":
+				s.quote = append(s.quote, s.abs(value))
+			case "-idirafter":
+				after = append(after, s.abs(value))
+			case "-include", "-imacros":
+				forced = append(forced, value)
+			default:
+				s.search = append(s.search, s.abs(value))
+			}
+			break
+		}
+	}
+
+	for _, item := range includes {
+		s.search = append(s.search, filepath.Join(root, item))
+	}
+
+	s.search = append(s.search, after...)
+
+	// forced headers are looked up like a quoted include of the directory the command runs in
+	for _, item := range forced {
+		p, err := s.resolve("", directive{name: item, quoted: true})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.visit(p); err != nil {
+			return nil, err
+		}
+	}
+
+	scanned := 0
+
+	for _, item := range sources {
+		if !isSourceFile(item) {
+			continue
+		}
+		p := filepath.Join(root, item)
+		s.seen[p] = true
+		if err := s.scan(p); err != nil {
+			return nil, err
+		}
+		scanned++
+	}
+
+	if scanned == 0 && len(includes) > 0 {
+		return nil, fmt.Errorf("no sources to scan in %s", strings.Join(sources, " "))
+	}
+
+	return s.files, nil
+}
+
+// includeFiles adds the headers sources include to files, shipping the include
+// directories whole when the scan cannot resolve them, along with the headers and
+// files of those directories the ignore rules kept out. Files are always kept
+func includeFiles(cache *includeCache, root, dir string, files, args, includes []string) ([]string, excluded, error) {
+	headers, err := scanIncludes(cache, root, dir, files, args, includes)
+	if err != nil {
+		log.Printf("Include scan fallback: %v\n", err)
+		if len(includes) == 0 {
+			return files, excluded{}, nil
+		}
+		return cache.index.appendFiles(root, files, includes)
+	}
+
+	var stats excluded
+
+	return cache.ignore.merge(root, files, headers, &stats), stats, nil
+}
+
+// mergeFiles appends the files of extra not yet in files
+func mergeFiles(files, extra []string) []string {
+	buf := slices.Clone(files)
+
+	seen := map[string]bool{}
+	for _, item := range files {
+		seen[item] = true
+	}
+
+	for _, item := range extra {
+		if !seen[item] {
+			seen[item] = true
+			buf = append(buf, item)
+		}
+	}
+
+	return buf
+}
+
+func isSourceFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, item := range sourceExts {
+		if ext == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *includeScanner) abs(name string) string {
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+
+	return filepath.Join(s.dir, name)
+}
+
+// scan visits each file once, so guarded and #pragma once headers are not rescanned
+func (s *includeScanner) scan(name string) error {
+	directives, err := s.cache.parse(name)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range directives {
+		p, err := s.resolve(name, item)
+		if err != nil {
+			return err
+		}
+		if err := s.visit(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// visit adds a resolved header and scans it, unless it was seen or is a system header
+func (s *includeScanner) visit(p string) error {
+	if p == "" || s.seen[p] {
+		return nil
+	}
+
+	s.seen[p] = true
+
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// headers outside the workspace are expected on the worker
+		return nil
+	}
+
+	s.files = append(s.files, rel)
+
+	return s.scan(p)
+}
+
+// resolve finds the header of a directive in from, or on the command line when from is
+// empty, returning empty for angled system headers not in the search paths, a quoted
+// header found nowhere cannot be resolved
+func (s *includeScanner) resolve(from string, item directive) (string, error) {
+	var dirs []string
+
+	base := s.dir
+	if from != "" {
+		base = filepath.Dir(from)
+	}
+
+	if item.quoted && !item.next {
+		dirs = append(dirs, base)
+		dirs = append(dirs, s.quote...)
+	}
+
+	dirs = append(dirs, s.search...)
+
+	if filepath.IsAbs(item.name) {
+		dirs = []string{""}
+	} else if item.next {
+		// #include_next continues after the directory of the including file
+		for i, dir := range dirs {
+			if dir == base {
+				dirs = dirs[i+1:]
+				break
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		p := filepath.Join(dir, item.name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p, nil
+		}
+	}
+
+	if item.quoted && from == "" {
+		return "", fmt.Errorf("cannot resolve forced include %s", item.name)
+	}
+
+	if item.quoted {
+		return "", fmt.Errorf("cannot resolve #include \"%s\" in %s", item.name, from)
+	}
+
+	return "", nil
+}
+
+func (c *includeCache) parse(name string) ([]directive, error) {
+	c.mutex.Lock()
+	directives, ok := c.directives[name]
+	err := c.errs[name]
+	c.mutex.Unlock()
+
+	if ok || err != nil {
+		return directives, err
+	}
+
+	directives, err = parseIncludes(name)
+
+	c.mutex.Lock()
+	c.directives[name] = directives
+	c.errs[name] = err
+	c.mutex.Unlock()
+
+	return directives, err
+}
+
+// parseIncludes reads the #include directives of name, failing on computed includes
+func parseIncludes(name string) ([]directive, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var directives []directive
+
+	comment := false
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var line string
+		line, comment = stripComments(scanner.Text(), comment)
+		match := includePattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		value := strings.TrimSpace(match[2])
+		item := directive{next: match[1] == "include_next"}
+		switch {
+		case strings.HasPrefix(value, `"`) && strings.Count(value, `"`) >= 2:
+			item.name = value[1 : strings.Index(value[1:], `"`)+1]
+			item.quoted = true
+		case strings.HasPrefix(value, "<") && strings.Contains(value, ">"):
+			item.name = value[1:strings.Index(value, ">")]
+		default:
+			return nil, fmt.Errorf("unresolvable include in %s: %s", name, value)
+		}
+		directives = append(directives, item)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+
+	return directives, nil
+}
+
+// stripComments removes // and /* */ comments, carrying an open block comment to the next line
+func stripComments(line string, comment bool) (string, bool) {
+	var buf strings.Builder
+
+	for i := 0; i < len(line); i++ {
+		if comment {
+			if strings.HasPrefix(line[i:], "*/") {
+				comment = false
+				i++
+			}
+			continue
+		}
+		if strings.HasPrefix(line[i:], "/*") {
+			comment = true
+			i++
+			buf.WriteByte(' ')
+			continue
+		}
+		if strings.HasPrefix(line[i:], "//") {
+			break
+		}
+		buf.WriteByte(line[i])
+	}
+
+	return buf.String(), comment
+}
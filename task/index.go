@@ -0,0 +1,263 @@
+package task
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// dirIndex memoizes the files found under include directories for a whole
+// run, so commands sharing includes walk each directory once
+type dirIndex struct {
+	mutex  sync.Mutex
+	dirs   map[dirKey]*dirEntry
+	sem    chan struct{}
+	ignore *Ignore
+}
+
+// dirKey is a directory and the path its files are reported under, which
+// differs from the directory when it was reached through a symlink
+type dirKey struct {
+	path string
+	link string
+}
+
+type dirEntry struct {
+	done  chan struct{}
+	files []walkFile
+	err   error
+}
+
+type walkFile struct {
+	name string
+	size int64
+}
+
+// excluded counts the files an ignore rule kept from a task
+type excluded struct {
+	files int
+	bytes int64
+}
+
+// log reports the files kept from t, if any
+func (e excluded) log(t BuildInfo) {
+	if e.files > 0 {
+		log.Printf("Excluded %d files (%d bytes) from %s\n", e.files, e.bytes, Label(t))
+	}
+}
+
+// newDirIndex indexes include directories, leaving out the files ignore matches
+func newDirIndex(ignore *Ignore) *dirIndex {
+	return &dirIndex{
+		dirs:   map[dirKey]*dirEntry{},
+		sem:    make(chan struct{}, runtime.NumCPU()),
+		ignore: ignore,
+	}
+}
+
+// appendFiles adds the files under the include paths of dir to inputFiles,
+// relative to dir and in walk order, and counts the ignored ones
+func (x *dirIndex) appendFiles(dir string, inputFiles []string, includePath []string) ([]string, excluded, error) {
+	var stats excluded
+
+	seen := map[string]bool{}
+	for _, item := range inputFiles {
+		seen[item] = true
+	}
+
+	add := func(file walkFile) error {
+		relativeFilePath, err := filepath.Rel(dir, file.name)
+		if err != nil {
+			return fmt.Errorf("fail to get relative path for %s: %v", file.name, err)
+		}
+		if len(relativeFilePath) == 0 || seen[relativeFilePath] {
+			return nil
+		}
+		seen[relativeFilePath] = true
+		if x.ignore.Match(relativeFilePath, false) {
+			stats.files++
+			stats.bytes += file.size
+			return nil
+		}
+		inputFiles = append(inputFiles, relativeFilePath)
+		return nil
+	}
+
+	for _, item := range includePath {
+		include := filepath.Join(dir, item)
+
+		isLink, err := isSymlink(include)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return inputFiles, stats, fmt.Errorf("path:%s not exist", include)
+			}
+			return inputFiles, stats, fmt.Errorf("fail to check symlink %s: %v", include, err)
+		}
+
+		path := include
+
+		if isLink {
+			resolvedPath, err := resolveSymlink(include)
+			if err != nil {
+				return inputFiles, stats, fmt.Errorf("fail to resolve symlink %s: %v", include, err)
+			}
+			if resolvedPath == "" {
+				continue
+			}
+			path = resolvedPath
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return inputFiles, stats, fmt.Errorf("path:%s not exist", path)
+			}
+			return inputFiles, stats, fmt.Errorf("fail to get path %s: %v", path, err)
+		}
+
+		if !info.IsDir() {
+			if err := add(walkFile{name: include, size: info.Size()}); err != nil {
+				return inputFiles, stats, err
+			}
+			continue
+		}
+
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			path = real
+		}
+
+		files, err := x.walk(path, include, nil)
+		if err != nil {
+			return inputFiles, stats, fmt.Errorf("error to traverse '%s': %v", path, err)
+		}
+
+		for _, file := range files {
+			if err := add(file); err != nil {
+				return inputFiles, stats, err
+			}
+		}
+	}
+
+	return inputFiles, stats, nil
+}
+
+// walk lists the files under the real directory path named under link, in
+// depth first order, walking subdirectories on the worker pool when it has room
+func (x *dirIndex) walk(path, link string, ancestors []string) ([]walkFile, error) {
+	key := dirKey{path: path, link: link}
+
+	x.mutex.Lock()
+	entry, ok := x.dirs[key]
+	if !ok {
+		entry = &dirEntry{done: make(chan struct{})}
+		x.dirs[key] = entry
+	}
+	x.mutex.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.files, entry.err
+	}
+
+	entry.files, entry.err = x.list(path, link, append(slices.Clip(ancestors), path))
+	close(entry.done)
+
+	return entry.files, entry.err
+}
+
+func (x *dirIndex) list(path, link string, ancestors []string) ([]walkFile, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read dir %s: %v", path, err)
+	}
+
+	// each entry contributes its files, or the files of its directory, in order
+	parts := make([][]walkFile, len(entries))
+	errs := make([]error, len(entries))
+
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		entryPath, linkEntryPath, info, err := resolveEntry(path, link, entry)
+		if err != nil {
+			errs[i] = err
+			break
+		}
+
+		if entryPath == "" {
+			continue
+		}
+
+		if !info.IsDir() {
+			parts[i] = []walkFile{{name: linkEntryPath, size: info.Size()}}
+			continue
+		}
+
+		// a symlink back to a directory being walked would never end
+		if slices.Contains(ancestors, entryPath) {
+			continue
+		}
+
+		select {
+		case x.sem <- struct{}{}:
+			wg.Add(1)
+			go func(i int, entryPath, linkEntryPath string) {
+				defer wg.Done()
+				parts[i], errs[i] = x.walk(entryPath, linkEntryPath, ancestors)
+				<-x.sem
+			}(i, entryPath, linkEntryPath)
+		default:
+			parts[i], errs[i] = x.walk(entryPath, linkEntryPath, ancestors)
+		}
+	}
+
+	wg.Wait()
+
+	var files []walkFile
+
+	for i := range entries {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		files = append(files, parts[i]...)
+	}
+
+	return files, nil
+}
+
+// resolveEntry follows a symlinked entry of path, returning an empty path for broken links
+func resolveEntry(path, link string, entry os.DirEntry) (string, string, os.FileInfo, error) {
+	entryPath := filepath.Join(path, entry.Name())
+	linkEntryPath := filepath.Join(link, entry.Name())
+
+	isLink, err := isSymlink(entryPath)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("fail to check symlink %s: %v", entryPath, err)
+	}
+
+	if isLink {
+		// is symlink: resolve real path
+		resolvedPath, err := resolveSymlink(entryPath)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("fail to resolve symlink %s: %v", entryPath, err)
+		}
+		if resolvedPath == "" {
+			return "", "", nil, nil
+		}
+		entryPath = resolvedPath
+	}
+
+	info, err := os.Stat(entryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil, fmt.Errorf("path:%s not exist", entryPath)
+		}
+		return "", "", nil, fmt.Errorf("fail to get path %s: %v", entryPath, err)
+	}
+
+	return entryPath, linkEntryPath, info, nil
+}
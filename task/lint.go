@@ -0,0 +1,157 @@
+package task
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// kinds of issues Lint reports
+const (
+	IssueMalformed         = "malformed"
+	IssueMissingInput      = "missing-input"
+	IssueInputNotInCommand = "input-not-in-command"
+	IssueEmptyOutput       = "empty-output"
+	IssueDuplicateOutput   = "duplicate-output"
+	IssueOutputOutside     = "output-outside-workspace"
+	IssueUnknownCompiler   = "unknown-compiler"
+)
+
+// Issue is a problem found in one command of a compile file
+type Issue struct {
+	Index   int    `json:"index"`
+	Offset  int64  `json:"offset"`
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// LintReport lists the issues of every command of a compile file
+type LintReport struct {
+	File     string  `json:"file"`
+	Commands int     `json:"commands"`
+	Issues   []Issue `json:"issues"`
+}
+
+// linter checks commands against the workspace and the commands before them
+type linter struct {
+	root    string
+	outputs map[string]int
+	report  *LintReport
+}
+
+// Lint validates the commands of the compile file under the out directory of path, or
+// at filename when it is absolute, an error means the file itself could not be read
+func Lint(path, filename string) (*LintReport, error) {
+	filePath := compilePath(path, filename)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open JSON file: %v", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace path: %v", err)
+	}
+
+	l := &linter{
+		root:    root,
+		outputs: map[string]int{},
+		report: &LintReport{
+			File:   filePath,
+			Issues: []Issue{},
+		},
+	}
+
+	err = decodeCommands(bufio.NewReaderSize(file, streamBufferSize), func(index int, offset int64, command Command, err error) bool {
+		l.report.Commands++
+		if err != nil {
+			l.add(index, offset, IssueMalformed, "", err.Error())
+			return true
+		}
+		l.check(index, offset, command)
+		return true
+	})
+
+	// a syntax error ends the file, it is reported with the commands before it
+	var entryErr *EntryError
+	if errors.As(err, &entryErr) {
+		l.report.Commands++
+		l.add(entryErr.Index, entryErr.Offset, IssueMalformed, "", entryErr.Err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	// inputs missing from disk may be intermediate outputs of other commands,
+	// which are only known once every command is read
+	l.report.Issues = slices.DeleteFunc(l.report.Issues, func(item Issue) bool {
+		return item.Kind == IssueMissingInput && l.produced(item.Path)
+	})
+
+	return l.report, nil
+}
+
+func (l *linter) check(index int, offset int64, command Command) {
+	if !isCompilerType(command.CompilerType) {
+		l.add(index, offset, IssueUnknownCompiler, "",
+			fmt.Sprintf("compiler type %q is not one of %s", command.CompilerType, strings.Join(compilerTypes, ", ")))
+	}
+
+	for _, item := range command.InputFiles {
+		if _, err := os.Stat(filepath.Join(l.root, item)); err != nil {
+			l.add(index, offset, IssueMissingInput, item, fmt.Sprintf("input %s does not exist", item))
+		}
+		if !strings.Contains(command.Command, item) {
+			l.add(index, offset, IssueInputNotInCommand, item, fmt.Sprintf("input %s does not appear in the command", item))
+		}
+	}
+
+	if command.OutputFile == "" {
+		l.add(index, offset, IssueEmptyOutput, "", "output file is empty, the command has no target")
+		return
+	}
+
+	output, err := workspaceRel(l.root, l.root, command.OutputFile)
+	if err != nil {
+		output = filepath.Clean(command.OutputFile)
+		l.add(index, offset, IssueOutputOutside, command.OutputFile, fmt.Sprintf("output %s is outside the workspace", command.OutputFile))
+	}
+
+	if first, ok := l.outputs[output]; ok {
+		l.add(index, offset, IssueDuplicateOutput, command.OutputFile, fmt.Sprintf("output %s is also produced by command %d", command.OutputFile, first))
+		return
+	}
+
+	l.outputs[output] = index
+}
+
+// produced reports whether a command of the file outputs name
+func (l *linter) produced(name string) bool {
+	rel, err := workspaceRel(l.root, l.root, name)
+	if err != nil {
+		rel = filepath.Clean(name)
+	}
+
+	_, ok := l.outputs[rel]
+
+	return ok
+}
+
+func (l *linter) add(index int, offset int64, kind, path, message string) {
+	l.report.Issues = append(l.report.Issues, Issue{
+		Index:   index,
+		Offset:  offset,
+		Kind:    kind,
+		Path:    path,
+		Message: message,
+	})
+}
@@ -0,0 +1,57 @@
+package task
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// WorkspacePlaceholder is the canonical workspace root sent to workers, it
+// resolves to the working directory of the process running the command
+const WorkspacePlaceholder = "/proc/self/cwd"
+
+// PrefixMap rewrites a workspace root to the placeholder and back
+type PrefixMap struct {
+	root  string
+	apply *regexp.Regexp
+}
+
+func NewPrefixMap(root string) *PrefixMap {
+	root = filepath.ToSlash(filepath.Clean(root))
+
+	return &PrefixMap{
+		root:  root,
+		apply: regexp.MustCompile(regexp.QuoteMeta(root) + `([^A-Za-z0-9_.\-]|$)`),
+	}
+}
+
+// Apply replaces the workspace root in s with the placeholder
+func (m *PrefixMap) Apply(s string) string {
+	if m.root == "/" || m.root == "." {
+		return s
+	}
+
+	return m.apply.ReplaceAllString(s, WorkspacePlaceholder+"${1}")
+}
+
+// Revert replaces the placeholder in s with the workspace root
+func (m *PrefixMap) Revert(s string) string {
+	return strings.ReplaceAll(s, WorkspacePlaceholder, m.root)
+}
+
+// Rel returns path relative to the workspace, whether it is relative,
+// under the workspace root or under the placeholder
+func (m *PrefixMap) Rel(path string) string {
+	p := filepath.ToSlash(path)
+
+	for _, prefix := range []string{WorkspacePlaceholder, m.root} {
+		if p == prefix {
+			return "."
+		}
+		if strings.HasPrefix(p, prefix+"/") {
+			return filepath.FromSlash(strings.TrimPrefix(p, prefix+"/"))
+		}
+	}
+
+	return path
+}
@@ -0,0 +1,45 @@
+package task
+
+import (
+	"context"
+)
+
+// Source loads the build tasks of a workspace
+type Source interface {
+	Load(context.Context) ([]BuildInfo, error)
+}
+
+type soongSource struct {
+	path     string
+	filename string
+	opts     *Options
+}
+
+// NewSoongSource reads the Soong compile file filename under path/out, or at filename when it is absolute
+func NewSoongSource(path, filename string, opts *Options) Source {
+	return &soongSource{
+		path:     path,
+		filename: filename,
+		opts:     opts,
+	}
+}
+
+func (s *soongSource) Load(_ context.Context) ([]BuildInfo, error) {
+	return compileDependency(s.path, s.filename, s.opts)
+}
+
+// StreamSource sends tasks while it is still reading them, for sources too large to load at once,
+// Outputs lists the files its tasks produce before any of them is sent
+type StreamSource interface {
+	Source
+	Stream(context.Context) (<-chan BuildInfo, <-chan error)
+	Outputs(context.Context) (map[string]bool, error)
+}
+
+func (s *soongSource) Stream(ctx context.Context) (<-chan BuildInfo, <-chan error) {
+	return StreamCompileDependency(ctx, s.path, s.filename, s.opts)
+}
+
+func (s *soongSource) Outputs(_ context.Context) (map[string]bool, error) {
+	return CompileOutputs(s.path, s.filename)
+}
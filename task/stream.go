@@ -0,0 +1,223 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	streamBufferSize = 1024 * 1024
+)
+
+// EntryError reports a malformed command of a compile file
+type EntryError struct {
+	Index  int
+	Offset int64
+	Err    error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("command %d at offset %d: %v", e.Index, e.Offset, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// StreamCompileDependency decodes the commands of a compile file one at a time and
+// sends their tasks while decoding continues. Malformed commands are reported as a
+// bare *EntryError and skipped, an error ending the stream is sent last, and both
+// channels are closed once the file is done or ctx is cancelled
+func StreamCompileDependency(ctx context.Context, path string, filename string, opts *Options) (<-chan BuildInfo, <-chan error) {
+	tasks := make(chan BuildInfo)
+	errs := make(chan error)
+
+	go func() {
+		defer close(tasks)
+		defer close(errs)
+
+		send := func(err error) bool {
+			select {
+			case errs <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if err := streamCommands(ctx, path, filename, opts, tasks, send); err != nil {
+			send(err)
+		}
+	}()
+
+	return tasks, errs
+}
+
+func streamCommands(ctx context.Context, path, filename string, opts *Options, tasks chan<- BuildInfo, send func(error) bool) error {
+	filePath := compilePath(path, filename)
+	log.Printf("Compile JSON: %s\n", filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open JSON file: %v", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	ignore, err := LoadIgnore(path, opts.Exclude)
+	if err != nil {
+		return fmt.Errorf("failed to load exclusion rules: %v", err)
+	}
+
+	cache := newIncludeCache(ignore)
+
+	db, err := OpenDepDB(path)
+	if err != nil {
+		log.Printf("failed to open dependency database: %v\n", err)
+	}
+
+	return decodeCommands(bufio.NewReaderSize(file, streamBufferSize), func(index int, offset int64, command Command, err error) bool {
+		if err == nil {
+			var task BuildInfo
+			if task, err = commandTask(cache, db, path, command); err == nil {
+				select {
+				case tasks <- task:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+		}
+		return send(&EntryError{Index: index, Offset: offset, Err: err})
+	})
+}
+
+// CompileOutputs returns the files the commands of a compile file produce, reading the
+// file once without scanning includes, malformed commands produce none
+func CompileOutputs(path, filename string) (map[string]bool, error) {
+	file, err := os.Open(compilePath(path, filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open JSON file: %v", err)
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	outputs := map[string]bool{}
+
+	err = decodeCommands(bufio.NewReaderSize(file, streamBufferSize), func(_ int, _ int64, command Command, err error) bool {
+		if err == nil {
+			for _, item := range commandTargets(command).BuildTargets {
+				outputs[filepath.Clean(item)] = true
+			}
+		}
+		return true
+	})
+
+	// the stream of the file reports its syntax error
+	var entryErr *EntryError
+	if err != nil && !errors.As(err, &entryErr) {
+		return nil, err
+	}
+
+	return outputs, nil
+}
+
+// compilePath is filename under the out directory of path, unless it is absolute
+func compilePath(path, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+
+	return filepath.Join(path, "out", filename)
+}
+
+// decodeCommands calls fn with each command of a compile file and its offset, or with
+// the error of an entry of the wrong shape, until fn returns false. A malformed file
+// fails with an *EntryError wrapped in the returned error
+func decodeCommands(r io.Reader, fn func(index int, offset int64, command Command, err error) bool) error {
+	decoder := json.NewDecoder(r)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return fmt.Errorf("failed to decode JSON: %v", err)
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+
+		if key != "commands" {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return fmt.Errorf("failed to decode JSON: %v", err)
+			}
+			continue
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+
+		if token == nil {
+			continue
+		}
+
+		if token != json.Delim('[') {
+			return fmt.Errorf("failed to decode JSON: unexpected %v at offset %d, expected '['", token, decoder.InputOffset())
+		}
+
+		for index := 0; decoder.More(); index++ {
+			var raw json.RawMessage
+			var command Command
+
+			offset := decoder.InputOffset()
+
+			if err := decoder.Decode(&raw); err != nil {
+				return fmt.Errorf("failed to decode JSON: %w", &EntryError{Index: index, Offset: offset, Err: err})
+			}
+
+			offset = decoder.InputOffset() - int64(len(raw))
+
+			// a well formed entry of the wrong shape is skipped, the stream goes on
+			err := json.Unmarshal(raw, &command)
+			if !fn(index, offset, command, err) {
+				return nil
+			}
+		}
+
+		if err := expectDelim(decoder, ']'); err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return fmt.Errorf("unexpected end of file, expected '%v'", delim)
+	}
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("unexpected %v at offset %d, expected '%v'", token, decoder.InputOffset(), delim)
+	}
+
+	return nil
+}
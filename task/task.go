@@ -1,9 +1,8 @@
 package task
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -11,6 +10,10 @@ import (
 	"strings"
 )
 
+var (
+	compilerTypes = []string{"clang", "clang++"}
+)
+
 type Command struct {
 	Command      string   `json:"command"`
 	CompilerType string   `json:"compilerType"`
@@ -28,6 +31,12 @@ type BuildInfo struct {
 	BuildRule    string
 	BuildFiles   []string
 	BuildTargets []string
+	// BuildPath is the directory the rule runs in relative to the workspace, empty for the workspace itself
+	BuildPath string
+	// Depfile is the depfile the rule writes relative to the workspace, also one of the targets
+	Depfile string
+	// Toolchain is the prebuilt compiler the rule was written for before it was normalized
+	Toolchain string
 }
 
 // Symlink or not
@@ -71,216 +80,101 @@ func resolveSymlink(path string) (string, error) {
 }
 
 func appendPathToInputFiles(dir string, inputFiles []string, includePath []string) ([]string, error) {
+	files, _, err := newDirIndex(nil).appendFiles(dir, inputFiles, includePath)
+	return files, err
+}
 
-	var walkDir func(path string, linkPath string) error
-	walkDir = func(path string, linkPath string) error {
-		entries, err := os.ReadDir(path)
-		if err != nil {
-			return fmt.Errorf("fail to read dir %s: %v", path, err)
-		}
-
-		for _, entry := range entries {
-			entryPath := filepath.Join(path, entry.Name())
-			linkEntryPath := filepath.Join(linkPath, entry.Name())
-
-			isLink, err := isSymlink(entryPath)
-			if err != nil {
-				return fmt.Errorf("fail to check symlink %s: %v", entryPath, err)
-			}
-
-			if isLink {
-				// is symlink: resolve real path
-				resolvedPath, err := resolveSymlink(entryPath)
-				if err != nil {
-					return fmt.Errorf("fail to resolve symlink %s: %v", entryPath, err)
-				}
-
-				if resolvedPath == "" {
-					continue
-				}
-
-				resolvedInfo, err := os.Stat(resolvedPath)
-				if err != nil {
-					if os.IsNotExist(err) {
-						return fmt.Errorf("resolved symlink target path:%s not exist", resolvedPath)
-					}
-					return fmt.Errorf("fail to get resolved symlink target path %s: %v", resolvedPath, err)
-				}
-
-				if resolvedInfo.IsDir() {
-					// recursive traversal dir
-					if err := walkDir(resolvedPath, linkEntryPath); err != nil {
-						return err
-					}
-				} else {
-					// add target file to inputFiles
-					relativeFilePath, err := filepath.Rel(dir, linkEntryPath)
-					if err != nil {
-						return fmt.Errorf("fail to get relative path for %s: %v", linkEntryPath, err)
-					}
-					if len(relativeFilePath) > 0 && !slices.Contains(inputFiles, relativeFilePath) {
-						inputFiles = append(inputFiles, relativeFilePath)
-					}
-				}
-			} else {
-				// not symlink
-				fileInfo, err := os.Stat(entryPath)
-				if err != nil {
-					if os.IsNotExist(err) {
-						return fmt.Errorf("path:%s not exist", entryPath)
-					}
-					return fmt.Errorf("fail to get path %s: %v", entryPath, err)
-				}
+// isCompilerType reports whether parseCommand knows the compiler type of a command
+func isCompilerType(compiletype string) bool {
+	return slices.Contains(compilerTypes, compiletype)
+}
 
-				if fileInfo.IsDir() {
-					// recursive traversal dir
-					if err := walkDir(entryPath, linkEntryPath); err != nil {
-						return err
-					}
-				} else {
-					// add target file to inputFiles
-					relativeFilePath, err := filepath.Rel(dir, linkEntryPath)
-					if err != nil {
-						return fmt.Errorf("fail to get relative path for %s: %v", linkEntryPath, err)
-					}
-					if len(relativeFilePath) > 0 && !slices.Contains(inputFiles, relativeFilePath) {
-						inputFiles = append(inputFiles, relativeFilePath)
-					}
-				}
-			}
-		}
-		return nil
+// parseCommand normalizes the prebuilt compiler of a command to the one of the worker,
+// and returns the prebuilt it replaced so that toolchains are told apart
+func parseCommand(command, compiletype string) (string, string) {
+	command = strings.Replace(command, "PWD=/proc/self/cwd ", "", 1)
+	if isCompilerType(compiletype) {
+		clangPattern := regexp.MustCompile(`prebuilts/clang/host/linux-x86/clang-[a-zA-Z0-9]+/bin/(clang\+\+|clang)`)
+		toolchain := clangPattern.FindString(command)
+		return clangPattern.ReplaceAllStringFunc(command, func(match string) string {
+			return clangPattern.FindStringSubmatch(match)[1]
+		}), toolchain
 	}
+	return command, ""
+}
 
-	// Traverse all inclusive items
-	for _, item := range includePath {
-		include := filepath.Join(dir, item)
-
-		isLink, err := isSymlink(include)
-		if err != nil {
-			if os.IsNotExist(err) {
-				return inputFiles, fmt.Errorf("path:%s not exist", include)
-			}
-			return inputFiles, fmt.Errorf("fail to check symlink %s: %v", include, err)
-		}
+func CompileDependency(path string, filename string) ([]BuildInfo, error) {
+	return compileDependency(path, filename, &Options{})
+}
 
-		if isLink {
-			resolvedPath, err := resolveSymlink(include)
-			if err != nil {
-				return inputFiles, fmt.Errorf("fail to resolve symlink %s: %v", include, err)
-			}
+func compileDependency(path string, filename string, opts *Options) ([]BuildInfo, error) {
+	var tasks []BuildInfo
 
-			if resolvedPath == "" {
-				continue
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			resolvedInfo, err := os.Stat(resolvedPath)
-			if err != nil {
-				if os.IsNotExist(err) {
-					return inputFiles, fmt.Errorf("resolved symlink target path:%s not exist", resolvedPath)
-				}
-				return inputFiles, fmt.Errorf("fail to get resolved symlink target path %s: %v", resolvedPath, err)
-			}
+	taskCh, errCh := StreamCompileDependency(ctx, path, filename, opts)
 
-			if resolvedInfo.IsDir() {
-				if err := walkDir(resolvedPath, include); err != nil {
-					return inputFiles, fmt.Errorf("error to traverse '%s': %v", resolvedPath, err)
-				}
-			} else {
-				relativeFilePath, err := filepath.Rel(dir, include)
-				if err != nil {
-					return inputFiles, fmt.Errorf("fail to get relative path for %s: %v", include, err)
-				}
-				if len(relativeFilePath) > 0 && !slices.Contains(inputFiles, relativeFilePath) {
-					inputFiles = append(inputFiles, relativeFilePath)
-				}
-			}
-		} else {
-			fileInfo, err := os.Stat(include)
-			if err != nil {
-				if os.IsNotExist(err) {
-					return inputFiles, fmt.Errorf("path:%s not exist", include)
-				}
-				return inputFiles, fmt.Errorf("fail to get path %s: %v", include, err)
+	for taskCh != nil || errCh != nil {
+		select {
+		case task, ok := <-taskCh:
+			if !ok {
+				taskCh = nil
+				continue
 			}
-
-			if fileInfo.IsDir() {
-				if err := walkDir(include, include); err != nil {
-					return inputFiles, fmt.Errorf("error to traverse '%s': %v", include, err)
-				}
-			} else {
-				relativeFilePath, err := filepath.Rel(dir, include)
-				if err != nil {
-					return inputFiles, fmt.Errorf("fail to get relative path for %s: %v", include, err)
-				}
-				if len(relativeFilePath) > 0 && !slices.Contains(inputFiles, relativeFilePath) {
-					inputFiles = append(inputFiles, relativeFilePath)
-				}
+			tasks = append(tasks, task)
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
 			}
+			return nil, err
 		}
 	}
 
-	return inputFiles, nil
-}
-
-func parseCommand(command, compiletype string) string {
-	command = strings.Replace(command, "PWD=/proc/self/cwd ", "", 1)
-	if compiletype == "clang" || compiletype == "clang++" {
-		clangPattern := regexp.MustCompile(`prebuilts/clang/host/linux-x86/clang-[a-zA-Z0-9]+/bin/(clang|clang\+\+)`)
-		return clangPattern.ReplaceAllStringFunc(command, func(match string) string {
-			return clangPattern.FindStringSubmatch(match)[1]
-		})
-	}
-	return command
+	return tasks, nil
 }
 
-func CompileDependency(path string, filename string) ([]BuildInfo, error) {
-	var tasks []BuildInfo
+// commandTargets converts the rule and the targets of one command of a compile file into a task
+func commandTargets(command Command) BuildInfo {
+	var task BuildInfo
 
-	filePath := filepath.Join(path, "out", filename)
-	log.Printf("Compile JSON: %s\n", filePath)
+	// command
+	task.BuildRule, task.Toolchain = parseCommand(command.Command, command.CompilerType)
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		return tasks, fmt.Errorf("failed to open JSON file: %v", err)
+	// targets
+	if command.OutputFile != "" {
+		task.BuildTargets = append(task.BuildTargets, command.OutputFile)
 	}
 
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	decoder := json.NewDecoder(file)
-
-	var compileInfo CompileInfo
-
-	err = decoder.Decode(&compileInfo)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode JSON: %v", err)
+	// depfile
+	if depfile := depfileArg(splitCommand(task.BuildRule)); depfile != "" && command.OutputFile != "" {
+		task.Depfile = depfile
+		task.BuildTargets = append(task.BuildTargets, depfile)
 	}
 
-	for _, command := range compileInfo.Commands {
-		var task BuildInfo
+	return task
+}
 
-		// command
-		task.BuildRule = parseCommand(command.Command, command.CompilerType)
+// commandTask converts one command of a compile file into a task
+func commandTask(cache *includeCache, db *DepDB, path string, command Command) (BuildInfo, error) {
+	var err error
+	var stats excluded
 
-		// targets
-		if command.OutputFile != "" {
-			task.BuildTargets = append(task.BuildTargets, command.OutputFile)
-		}
+	task := commandTargets(command)
+	args := splitCommand(task.BuildRule)
 
-		// buildFiles
-		task.BuildFiles = command.InputFiles
-		if len(command.Includes) > 0 {
-			task.BuildFiles, err = appendPathToInputFiles(path, task.BuildFiles, command.Includes)
-			if err != nil {
-				return nil, fmt.Errorf("failed to append include path: %v", err)
-			}
+	// buildFiles, exact if a previous build recorded them
+	if inputs, ok := db.Lookup(path, command.OutputFile, task.BuildRule); ok {
+		task.BuildFiles = cache.ignore.merge(path, command.InputFiles, inputs, &stats)
+	} else {
+		task.BuildFiles, stats, err = includeFiles(cache, path, path, command.InputFiles, args, command.Includes)
+		if err != nil {
+			return task, fmt.Errorf("failed to append include path: %v", err)
 		}
-
-		// all tasks
-		tasks = append(tasks, task)
 	}
 
-	return tasks, nil
+	stats.log(task)
+
+	return task, nil
 }
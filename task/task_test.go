@@ -1,9 +1,13 @@
 package task
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -116,3 +120,494 @@ func TestCompileDependency(t *testing.T) {
 	assert.Equal(t, expectedTasks, tasks)
 	_ = os.RemoveAll(dir)
 }
+
+func TestNewGraph(t *testing.T) {
+	g, err := NewGraph([]BuildInfo{
+		{BuildRule: "link", BuildFiles: []string{"out/a.o", "out/b.o"}, BuildTargets: []string{"out/main"}},
+		{BuildRule: "cc a", BuildFiles: []string{"a.c"}, BuildTargets: []string{"out/a.o"}},
+		{BuildRule: "cc b", BuildFiles: []string{"b.c"}, BuildTargets: []string{"out/b.o"}},
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1, 2}, g.Nodes[0].Deps)
+	assert.Equal(t, []int{0}, g.Nodes[1].Dependents)
+	assert.Equal(t, 0, len(g.Nodes[1].Deps))
+
+	_, err = NewGraph([]BuildInfo{
+		{BuildRule: "a", BuildFiles: []string{"c"}, BuildTargets: []string{"a"}},
+		{BuildRule: "b", BuildFiles: []string{"a"}, BuildTargets: []string{"b"}},
+		{BuildRule: "c", BuildFiles: []string{"b"}, BuildTargets: []string{"c"}},
+	})
+	assert.EqualError(t, err, "dependency cycle: a -> c -> b -> a")
+
+	_, err = NewGraph([]BuildInfo{
+		{BuildRule: "a", BuildTargets: []string{"a"}},
+		{BuildRule: "b", BuildTargets: []string{"a"}},
+	})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPrefixMap(t *testing.T) {
+	m := NewPrefixMap("/home/alice/aosp/")
+
+	rule := "clang -I/home/alice/aosp/include -c /home/alice/aosp/a.c -o out/a.o -I/home/alice/aosp2"
+	mapped := m.Apply(rule)
+	assert.Equal(t, "clang -I/proc/self/cwd/include -c /proc/self/cwd/a.c -o out/a.o -I/home/alice/aosp2", mapped)
+	assert.Equal(t, strings.ReplaceAll(mapped, "alice", "bob"), NewPrefixMap("/home/bob/aosp").Apply(strings.ReplaceAll(rule, "alice", "bob")))
+	assert.Equal(t, rule, m.Revert(mapped))
+
+	assert.Equal(t, filepath.FromSlash("out/a.o"), m.Rel("/proc/self/cwd/out/a.o"))
+	assert.Equal(t, filepath.FromSlash("out/a.o"), m.Rel("/home/alice/aosp/out/a.o"))
+	assert.Equal(t, "out/a.o", m.Rel("out/a.o"))
+	assert.Equal(t, "/usr/include/a.h", m.Rel("/usr/include/a.h"))
+}
+
+func TestCompdbSource(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "include"), os.ModePerm)
+	assert.Equal(t, nil, err)
+
+	err = os.WriteFile(filepath.Join(dir, "include", "a.h"), nil, 0644)
+	assert.Equal(t, nil, err)
+
+	commands := []CompileCommand{
+		{
+			Directory: filepath.Join(dir, "build"),
+			Arguments: []string{"clang", "-I../include", "-isystem", "/usr/include", "-c", "../a.c", "-o", "a.o"},
+			File:      "../a.c",
+		},
+		{
+			Directory: dir,
+			Command:   `clang -DNAME="\"b\"" -c b.c -o out/b.o`,
+			File:      filepath.Join(dir, "b.c"),
+			Output:    "out/b.o",
+		},
+	}
+
+	data, err := json.Marshal(commands)
+	assert.Equal(t, nil, err)
+
+	name := filepath.Join(dir, "compile_commands.json")
+
+	err = os.WriteFile(name, data, 0644)
+	assert.Equal(t, nil, err)
+
+	tasks, err := NewCompdbSource(dir, name, &Options{}).Load(context.Background())
+	assert.Equal(t, nil, err)
+
+	expectedTasks := []BuildInfo{
+		{
+			BuildRule:    "clang -I../include -isystem /usr/include -c ../a.c -o a.o",
+			BuildFiles:   []string{"a.c", filepath.FromSlash("include/a.h")},
+			BuildTargets: []string{filepath.FromSlash("build/a.o")},
+			BuildPath:    "build",
+		},
+		{
+			BuildRule:    `clang -DNAME="\"b\"" -c b.c -o out/b.o`,
+			BuildFiles:   []string{"b.c"},
+			BuildTargets: []string{filepath.FromSlash("out/b.o")},
+		},
+	}
+
+	assert.Equal(t, expectedTasks, tasks)
+}
+
+func TestParseCommand(t *testing.T) {
+	rule, toolchain := parseCommand("PWD=/proc/self/cwd prebuilts/clang/host/linux-x86/clang-r498229/bin/clang++ -c a.cpp", "clang++")
+	assert.Equal(t, "clang++ -c a.cpp", rule)
+	assert.Equal(t, "prebuilts/clang/host/linux-x86/clang-r498229/bin/clang++", toolchain)
+
+	rule, toolchain = parseCommand("gcc -c a.c", "gcc")
+	assert.Equal(t, "gcc -c a.c", rule)
+	assert.Equal(t, "", toolchain)
+}
+
+func TestSplitCommand(t *testing.T) {
+	args := splitCommand(`clang -DNAME="\"b\"" -I 'my dir' a\ b.c`)
+	assert.Equal(t, []string{"clang", `-DNAME="b"`, "-I", "my dir", "a b.c"}, args)
+
+	assert.Equal(t, `clang -I 'my dir' a.c`, joinCommand([]string{"clang", "-I", "my dir", "a.c"}))
+}
+
+func TestScanIncludes(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"src/main.cpp":       "#include \"local.h\"\n#include <lib/a.h>\n// #include \"missing.h\"\n/* #include HIDDEN */\n#include <stdio.h>\n",
+		"src/local.h":        "#pragma once\n#include \"local.h\"\n",
+		"src/macro.cpp":      "#define HEADER <lib/a.h>\n#include HEADER\n",
+		"src/quoted.cpp":     "#include <stdio.h>\n#include \"gone.h\"\n",
+		"src/late.cpp":       "#include <late.h>\n",
+		"include/config.h":   "#include <lib/b.h>\n#include \"defs.h\"\n",
+		"include/defs.h":     "",
+		"after/late.h":       "",
+		"include/lib/a.h":    "#ifndef A_H\n#define A_H\n#include <lib/b.h>\n#endif\n",
+		"include/lib/b.h":    "#include <lib/a.h>\n",
+		"include/lib/next.h": "",
+	}
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		assert.Equal(t, nil, err)
+		err = os.WriteFile(p, []byte(data), 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	cache := newIncludeCache(nil)
+	args := []string{"clang++", "-Iinclude", "-c", "src/main.cpp"}
+
+	headers, err := scanIncludes(cache, dir, dir, []string{"src/main.cpp"}, args, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{filepath.FromSlash("src/local.h"), filepath.FromSlash("include/lib/a.h"), filepath.FromSlash("include/lib/b.h")}, headers)
+
+	_, err = scanIncludes(cache, dir, dir, []string{"src/macro.cpp"}, args, nil)
+	assert.NotEqual(t, nil, err)
+
+	// only angled headers missing from the search paths are left to the worker
+	_, err = scanIncludes(cache, dir, dir, []string{"src/quoted.cpp"}, args, nil)
+	assert.NotEqual(t, nil, err)
+
+	// forced headers are scanned too, -idirafter paths are searched last
+	args = []string{"clang++", "-Iinclude", "-include", "include/config.h", "-imacros", "src/local.h", "-idirafter", "after", "-c", "src/late.cpp"}
+
+	headers, err = scanIncludes(cache, dir, dir, []string{"src/late.cpp"}, args, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{
+		filepath.FromSlash("include/config.h"),
+		filepath.FromSlash("include/lib/b.h"),
+		filepath.FromSlash("include/lib/a.h"),
+		filepath.FromSlash("include/defs.h"),
+		filepath.FromSlash("src/local.h"),
+		filepath.FromSlash("after/late.h"),
+	}, headers)
+
+	_, err = scanIncludes(cache, dir, dir, []string{"src/late.cpp"}, []string{"clang++", "-include", "gone.h", "-c", "src/late.cpp"}, nil)
+	assert.NotEqual(t, nil, err)
+
+	args = []string{"clang++", "-Iinclude", "-c", "src/main.cpp"}
+
+	buf, _, err := includeFiles(cache, dir, dir, []string{"src/macro.cpp"}, args, []string{"include"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, len(buf))
+	assert.Equal(t, true, strings.Contains(strings.Join(buf, " "), filepath.FromSlash("include/lib/next.h")))
+}
+
+func TestMergeFiles(t *testing.T) {
+	files := []string{"a.c", "a.h"}
+
+	assert.Equal(t, []string{"a.c", "a.h", "b.h", "c.h"}, mergeFiles(files, []string{"a.h", "b.h", "c.h", "b.h"}))
+	assert.Equal(t, []string{"a.c", "a.h"}, files)
+}
+
+func TestParseDepfile(t *testing.T) {
+	data := "out/a.o out/a.d: src/a.c \\\n  include/a\\ b.h /usr/include/stdio.h \\\n  include/c.h\n\ninclude/c.h:\n"
+
+	targets, inputs, err := ParseDepfile([]byte(data))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"out/a.o", "out/a.d"}, targets)
+	assert.Equal(t, []string{"src/a.c", "include/a b.h", "/usr/include/stdio.h", "include/c.h"}, inputs)
+
+	_, _, err = ParseDepfile([]byte("out/a.o src/a.c\n"))
+	assert.NotEqual(t, nil, err)
+
+	assert.Equal(t, "a.d", depfileArg([]string{"gcc", "-MD", "-MF", "a.d", "-c", "a.c", "-o", "a.o"}))
+	assert.Equal(t, filepath.FromSlash("out/a.d"), depfileArg([]string{"gcc", "-MMD", "-c", "a.c", "-o", "out/a.o"}))
+	assert.Equal(t, "", depfileArg([]string{"gcc", "-c", "a.c", "-o", "a.o"}))
+}
+
+func TestDepDB(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "a.c"), []byte("#include \"a.h\"\n"), 0644)
+	assert.Equal(t, nil, err)
+	err = os.WriteFile(filepath.Join(dir, "a.h"), nil, 0644)
+	assert.Equal(t, nil, err)
+
+	db, err := OpenDepDB(dir)
+	assert.Equal(t, nil, err)
+
+	_, ok := db.Lookup(dir, "a.o", "cc -c a.c -o a.o")
+	assert.Equal(t, false, ok)
+
+	err = db.Record(dir, "a.o", "cc -c a.c -o a.o", []string{"a.c", "a.h"})
+	assert.Equal(t, nil, err)
+
+	err = db.Save()
+	assert.Equal(t, nil, err)
+
+	db, err = OpenDepDB(dir)
+	assert.Equal(t, nil, err)
+
+	inputs, ok := db.Lookup(dir, "a.o", "cc  -c a.c -o a.o")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, []string{"a.c", "a.h"}, inputs)
+
+	_, ok = db.Lookup(dir, "a.o", "cc -O2 -c a.c -o a.o")
+	assert.Equal(t, false, ok)
+
+	err = os.WriteFile(filepath.Join(dir, "a.h"), []byte("#include \"b.h\"\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	_, ok = db.Lookup(dir, "a.o", "cc -c a.c -o a.o")
+	assert.Equal(t, false, ok)
+}
+
+func TestDirIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, item := range []string{"inc/b/b.h", "inc/a.h", "inc/c/d/d.h", "real/r.h"} {
+		p := filepath.Join(dir, filepath.FromSlash(item))
+		err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		assert.Equal(t, nil, err)
+		err = os.WriteFile(p, nil, 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	err := os.Symlink(filepath.FromSlash("../real"), filepath.Join(dir, "inc", "link"))
+	assert.Equal(t, nil, err)
+	err = os.Symlink(filepath.FromSlash("../missing"), filepath.Join(dir, "inc", "broken"))
+	assert.Equal(t, nil, err)
+	err = os.Symlink(filepath.FromSlash("../../inc"), filepath.Join(dir, "inc", "c", "loop"))
+	assert.Equal(t, nil, err)
+
+	expected := []string{
+		"a.c",
+		filepath.FromSlash("inc/a.h"),
+		filepath.FromSlash("inc/b/b.h"),
+		filepath.FromSlash("inc/c/d/d.h"),
+		filepath.FromSlash("inc/link/r.h"),
+	}
+
+	index := newDirIndex(nil)
+
+	for i := 0; i < 2; i++ {
+		files, _, err := index.appendFiles(dir, []string{"a.c", filepath.FromSlash("inc/a.h")}, []string{"inc", "inc/b"})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, files)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	g := ParseIgnore([]string{
+		"# comment",
+		".git/",
+		"*.png",
+		"!keep.png",
+		"/docs",
+		"test/**/data",
+		"**/*.o",
+	})
+
+	tests := map[string]bool{
+		".git/config":              true,
+		"include/.git/HEAD":        true,
+		"include/a.h":              false,
+		"include/logo.png":         true,
+		"include/keep.png":         false,
+		"docs/a.md":                true,
+		"include/docs/a.h":         false,
+		"test/unit/data/input.txt": true,
+		"test/data":                true,
+		"test/unit/a.h":            false,
+		"lib/a.o":                  true,
+	}
+
+	for name, expected := range tests {
+		assert.Equal(t, expected, g.Match(filepath.FromSlash(name), false), name)
+	}
+
+	var nilIgnore *Ignore
+	assert.Equal(t, false, nilIgnore.Match("a.h", false))
+}
+
+func TestLoadIgnore(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, item := range []string{"inc/a.h", "inc/.git/HEAD", "inc/logo.png", "inc/docs/a.md"} {
+		p := filepath.Join(dir, filepath.FromSlash(item))
+		err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		assert.Equal(t, nil, err)
+		err = os.WriteFile(p, []byte("data"), 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	err := os.WriteFile(filepath.Join(dir, IgnoreName), []byte(".git/\n*.png\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	ignore, err := LoadIgnore(dir, []string{"inc/docs"})
+	assert.Equal(t, nil, err)
+
+	files, stats, err := newDirIndex(ignore).appendFiles(dir, nil, []string{"inc"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{filepath.FromSlash("inc/a.h")}, files)
+	assert.Equal(t, excluded{files: 3, bytes: 12}, stats)
+}
+
+func TestExclude(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"src/a.c":      "#include \"a.pb.h\"\n#include \"b.h\"\n",
+		"src/a.pb.h":   "int a;\n",
+		"src/b.h":      "int b;\n",
+		"out/gen.pb.h": "int gen;\n",
+		IgnoreName:     "*.pb.h\n",
+	}
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		assert.Equal(t, nil, err)
+		err = os.WriteFile(p, []byte(data), 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	data := `{"commands": [
+{"command": "clang -c src/a.c -o out/a.o", "compilerType": "clang", "inputFiles": ["src/a.c"], "outputFile": "out/a.o"}
+]}`
+
+	err := os.WriteFile(filepath.Join(dir, "out", "compile.json"), []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	// headers found by the include scanner are excluded too
+	tasks, err := CompileDependency(dir, "compile.json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"src/a.c", filepath.FromSlash("src/b.h")}, tasks[0].BuildFiles)
+
+	// the declared input is kept when a rule matches it
+	tasks, err = compileDependency(dir, "compile.json", &Options{Exclude: []string{"src/"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"src/a.c"}, tasks[0].BuildFiles)
+
+	ignore, err := LoadIgnore(dir, []string{"src/b.h"})
+	assert.Equal(t, nil, err)
+
+	// recorded headers are excluded, declared inputs are kept even when matched
+	task := BuildInfo{BuildFiles: []string{"src/a.c", "src/b.h"}, BuildTargets: []string{"out/a.o"}}
+	ignore.Merge(dir, &task, []string{"src/a.c", "src/b.h", "out/gen.pb.h", "src/c.h"})
+	assert.Equal(t, []string{"src/a.c", "src/b.h", "src/c.h"}, task.BuildFiles)
+}
+
+func TestCompileOutputs(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "out"), os.ModePerm)
+	assert.Equal(t, nil, err)
+
+	data := `{"commands": [
+{"command": "clang++ out/a.o -o out/a", "compilerType": "clang++", "inputFiles": ["out/a.o"], "outputFile": "out/a"},
+{"command": 5, "outputFile": "out/b.o"},
+{"command": "clang -MD -c a.c -o out/a.o", "compilerType": "clang", "inputFiles": ["a.c"], "outputFile": "out/./a.o"}
+]}`
+
+	err = os.WriteFile(filepath.Join(dir, "out", "compile.json"), []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	outputs, err := CompileOutputs(dir, "compile.json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]bool{"out/a": true, "out/a.o": true, "out/a.d": true}, outputs)
+
+	_, err = CompileOutputs(dir, "missing.json")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestStreamCompileDependency(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "out"), os.ModePerm)
+	assert.Equal(t, nil, err)
+
+	data := `{"version": 1, "commands": [
+{"command": "cc -c a.c -o a.o", "compilerType": "gcc", "inputFiles": ["a.c"], "outputFile": "a.o"},
+{"command": 5, "outputFile": "b.o"},
+{"command": "cc -c c.c -o c.o", "compilerType": "gcc", "inputFiles": ["c.c"], "outputFile": "c.o"}
+]}`
+
+	err = os.WriteFile(filepath.Join(dir, "out", "compile.json"), []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	taskCh, errCh := StreamCompileDependency(context.Background(), dir, "compile.json", &Options{})
+
+	var tasks []BuildInfo
+	var errs []error
+
+	for taskCh != nil || errCh != nil {
+		select {
+		case item, ok := <-taskCh:
+			if !ok {
+				taskCh = nil
+				continue
+			}
+			tasks = append(tasks, item)
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, []string{"c.o"}, tasks[1].BuildTargets)
+	assert.Equal(t, 1, len(errs))
+
+	var entryErr *EntryError
+	assert.Equal(t, true, errors.As(errs[0], &entryErr))
+	assert.Equal(t, 1, entryErr.Index)
+	assert.Equal(t, int64(strings.Index(data, `{"command": 5`)), entryErr.Offset)
+
+	err = os.WriteFile(filepath.Join(dir, "out", "compile.json"), []byte(`{"commands": [{"command": "cc"}, {"command": `), 0644)
+	assert.Equal(t, nil, err)
+
+	_, err = CompileDependency(dir, "compile.json")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, errors.As(err, &entryErr))
+	assert.Equal(t, 1, entryErr.Index)
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "out"), os.ModePerm)
+	assert.Equal(t, nil, err)
+
+	err = os.WriteFile(filepath.Join(dir, "a.c"), []byte("int a;\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	data := `{"commands": [
+{"command": "clang -c a.c -o a.o", "compilerType": "clang", "inputFiles": ["a.c"], "outputFile": "a.o"},
+{"command": "clang -c a.c -o a.o", "compilerType": "clang", "inputFiles": ["a.c"], "outputFile": "a.o"},
+{"command": "gcc -c b.c", "compilerType": "gcc", "inputFiles": ["b.c"], "outputFile": ""},
+{"command": "clang -c a.c -o /tmp/a.o", "compilerType": "clang", "inputFiles": ["a.c", "x.c"], "outputFile": "/tmp/a.o"},
+{"command": "clang++ c.o out/b.o -o out/c", "compilerType": "clang++", "inputFiles": ["out/b.o"], "outputFile": "out/c"},
+{"command": "clang -c a.c -o out/b.o", "compilerType": "clang", "inputFiles": ["a.c"], "outputFile": "out/b.o"},
+{"command": 5}
+]}`
+
+	err = os.WriteFile(filepath.Join(dir, "out", "compile.json"), []byte(data), 0644)
+	assert.Equal(t, nil, err)
+
+	report, err := Lint(dir, "compile.json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 7, report.Commands)
+
+	var kinds []string
+	for _, item := range report.Issues {
+		kinds = append(kinds, fmt.Sprintf("%d:%s", item.Index, item.Kind))
+	}
+
+	assert.Equal(t, []string{
+		"1:" + IssueDuplicateOutput,
+		"2:" + IssueUnknownCompiler,
+		"2:" + IssueMissingInput,
+		"2:" + IssueEmptyOutput,
+		"3:" + IssueMissingInput,
+		"3:" + IssueInputNotInCommand,
+		"3:" + IssueOutputOutside,
+		"6:" + IssueMalformed,
+	}, kinds)
+
+	assert.Equal(t, int64(strings.Index(data, `{"command": 5`)), report.Issues[7].Offset)
+}